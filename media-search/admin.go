@@ -0,0 +1,268 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/mongo"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+)
+
+// adminToken is the bearer token that authorizes /admin requests.
+// The admin API is disabled while it is empty.
+var adminToken string
+
+// adminAuditCollection records every admin action.
+var adminAuditCollection *mongo.Collection
+
+// adminStatsViews are the views whose live values /admin/stats reports.
+var adminStatsViews = []string{
+	"cache_hits", "cache_misses", "cache_stale_served", "cache_insertion_errors", "cache_lookup_errors",
+	"coalesced_requests", "youtube_api_errors", "mongo_errors", "validation_failures",
+	"quota_rejections", "youtube_quota_remaining", "breaker_transitions",
+}
+
+func setupAdmin(db *mongo.Database) {
+	adminAuditCollection = db.Collection("admin_audit")
+}
+
+// adminHandler serves the admin API, for inspecting and
+// invalidating the cache, to requests bearing adminToken.
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/cache", adminCache)
+	mux.HandleFunc("/admin/cache/flush", adminFlush)
+	mux.HandleFunc("/admin/stats", adminStats)
+	return requireAdmin(mux)
+}
+
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			writeJSONError(w, http.StatusNotFound, errors.New("the admin API is disabled"))
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			_, span := trace.StartSpan(r.Context(), "/admin-unauthorized")
+			span.SetStatus(trace.Status{Code: trace.StatusCodeUnauthenticated, Message: "invalid admin token"})
+			span.End()
+			log.Printf("admin: unauthorized %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="media-search admin"`)
+			writeJSONError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type auditEntry struct {
+	Action     string    `bson:"action"`
+	Target     string    `bson:"target,omitempty"`
+	Deleted    int64     `bson:"deleted"`
+	Error      string    `bson:"error,omitempty"`
+	RemoteAddr string    `bson:"remote_addr"`
+	UserAgent  string    `bson:"user_agent,omitempty"`
+	TraceID    string    `bson:"trace_id"`
+	Time       time.Time `bson:"time"`
+}
+
+// audit logs an admin action that deleted n entries matching target
+// and records it in the admin_audit collection, with the ID of the
+// action's trace so that the two can be cross-referenced.
+func audit(ctx context.Context, r *http.Request, action, target string, n int64, actionErr error) {
+	entry := &auditEntry{
+		Action:     action,
+		Target:     target,
+		Deleted:    n,
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+		TraceID:    trace.FromContext(ctx).SpanContext().TraceID.String(),
+		Time:       time.Now(),
+	}
+	if actionErr != nil {
+		entry.Error = actionErr.Error()
+	}
+	log.Printf("admin: %s target=%q deleted=%d remote=%s trace=%s err=%q",
+		action, target, n, entry.RemoteAddr, entry.TraceID, entry.Error)
+	if adminAuditCollection == nil {
+		return
+	}
+	if _, err := adminAuditCollection.InsertOne(ctx, entry); err != nil {
+		log.Printf("admin: failed to record the audit entry: %v", err)
+	}
+}
+
+type adminCacheEntry struct {
+	*cacheEntryInfo
+	Age       string `json:"age"`
+	ExpiresIn string `json:"expires_in"`
+	Stale     bool   `json:"stale"`
+}
+
+// adminCache lists the cache entries whose keys start with the "prefix"
+// parameter on GET and, on DELETE, invalidates the entry with the "key"
+// parameter or all the entries whose keys start with "prefix". Instead of
+// "prefix", "q" selects the searches whose keywords start with it.
+func adminCache(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		ctx, span := trace.StartSpan(r.Context(), "/admin/cache-list")
+		defer span.End()
+
+		prefix := keyPrefix(r)
+		infos, err := resultCache.List(ctx, prefix)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].CacheTime.After(infos[j].CacheTime) })
+		if limit := int(intParam(r, "limit", 100, 10000)); len(infos) > limit {
+			infos = infos[:limit]
+		}
+
+		now := time.Now()
+		entries := make([]*adminCacheEntry, 0, len(infos))
+		for _, info := range infos {
+			entries = append(entries, &adminCacheEntry{
+				cacheEntryInfo: info,
+				Age:            now.Sub(info.CacheTime).Round(time.Second).String(),
+				ExpiresIn:      info.Expires.Sub(now).Round(time.Second).String(),
+				Stale:          now.Sub(info.CacheTime) > cacheTTL,
+			})
+		}
+		writeJSON(w, entries)
+
+	case "DELETE":
+		ctx, span := trace.StartSpan(r.Context(), "/admin/cache-invalidate")
+		defer span.End()
+
+		key, prefix := r.URL.Query().Get("key"), keyPrefix(r)
+		var n int64
+		var err error
+		switch {
+		case key != "":
+			span.AddAttributes(trace.StringAttribute("key", key))
+			var deleted bool
+			if deleted, err = resultCache.Delete(ctx, key); deleted {
+				n = 1
+			}
+			audit(ctx, r, "invalidate_key", key, n, err)
+		case prefix != "":
+			span.AddAttributes(trace.StringAttribute("prefix", prefix))
+			n, err = resultCache.DeletePrefix(ctx, prefix)
+			audit(ctx, r, "invalidate_prefix", prefix, n, err)
+		default:
+			writeJSONError(w, http.StatusBadRequest, &validationError{Fields: []*fieldError{
+				{Field: "key", Message: "either key, prefix or q is required, use /admin/cache/flush to flush everything"},
+			}})
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, map[string]int64{"deleted": n})
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("only GET and DELETE are supported"))
+	}
+}
+
+// keyPrefix returns the "prefix" parameter of r or, if "q" is set instead,
+// the prefix of the keys of the searches whose keywords start with it.
+func keyPrefix(r *http.Request) string {
+	if q := r.URL.Query().Get("q"); q != "" {
+		return keywordsKeyPrefix(q)
+	}
+	return r.URL.Query().Get("prefix")
+}
+
+// adminFlush removes every entry from the cache.
+func adminFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("only POST is supported"))
+		return
+	}
+	ctx, span := trace.StartSpan(r.Context(), "/admin/cache-flush")
+	defer span.End()
+
+	n, err := resultCache.DeletePrefix(ctx, "")
+	audit(ctx, r, "flush", "", n, err)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, map[string]int64{"deleted": n})
+}
+
+type adminStatsRow struct {
+	Tags  map[string]string `json:"tags,omitempty"`
+	Value float64           `json:"value"`
+}
+
+// adminStats reports the current values of adminStatsViews,
+// along with the circuit breaker's state.
+func adminStats(w http.ResponseWriter, r *http.Request) {
+	_, span := trace.StartSpan(r.Context(), "/admin/stats")
+	defer span.End()
+
+	views := make(map[string][]*adminStatsRow)
+	for _, name := range adminStatsViews {
+		rows, err := view.RetrieveData(name)
+		if err != nil {
+			span.Annotate([]trace.Attribute{trace.StringAttribute("view", name)}, err.Error())
+			continue
+		}
+		statsRows := make([]*adminStatsRow, 0, len(rows))
+		for _, row := range rows {
+			statsRow := &adminStatsRow{Tags: make(map[string]string)}
+			for _, t := range row.Tags {
+				statsRow.Tags[t.Key.Name()] = t.Value
+			}
+			switch data := row.Data.(type) {
+			case *view.CountData:
+				statsRow.Value = float64(data.Value)
+			case *view.SumData:
+				statsRow.Value = data.Value
+			case *view.LastValueData:
+				statsRow.Value = data.Value
+			case *view.DistributionData:
+				statsRow.Value = float64(data.Count)
+			}
+			statsRows = append(statsRows, statsRow)
+		}
+		views[name] = statsRows
+	}
+
+	body := map[string]interface{}{
+		"cache_backend": resultCache.Name(),
+		"views":         views,
+	}
+	if breaker != nil {
+		body["breaker_open"] = breaker.isOpen()
+	}
+	writeJSON(w, body)
+}
@@ -0,0 +1,226 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+// maxResultsPerPageLimit is the YouTube Data API's own limit.
+const maxResultsPerPageLimit = 50
+
+// maxPagesLimit is the most pages that a single search may ask for.
+var maxPagesLimit int64
+
+// fieldError is a validation failure of a single request field.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (fe *fieldError) Error() string { return fe.Field + " " + fe.Message }
+
+// validationError holds every invalid field of a request.
+type validationError struct {
+	Fields []*fieldError
+}
+
+func (ve *validationError) Error() string {
+	msgs := make([]string, 0, len(ve.Fields))
+	for _, fe := range ve.Fields {
+		msgs = append(msgs, fe.Error())
+	}
+	return "invalid request: " + strings.Join(msgs, ", ")
+}
+
+// bindQuery parses a search query from the URL query string of GET
+// requests or from the form or JSON body of POST and PUT requests.
+// Bodies are assumed to be JSON unless their Content-Type says otherwise.
+func bindQuery(ctx context.Context, req *http.Request) (*query, []*fieldError) {
+	switch req.Method {
+	case "GET":
+		return bindValues(req.URL.Query())
+
+	case "POST", "PUT":
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/x-www-form-urlencoded":
+			if err := req.ParseForm(); err != nil {
+				return nil, []*fieldError{{Field: "body", Message: err.Error()}}
+			}
+			return bindValues(req.Form)
+		case "multipart/form-data":
+			if err := req.ParseMultipartForm(1 << 20); err != nil {
+				return nil, []*fieldError{{Field: "body", Message: err.Error()}}
+			}
+			return bindValues(req.Form)
+		default:
+			return bindJSON(ctx, req.Body)
+		}
+
+	default:
+		return nil, []*fieldError{{Field: "method", Message: fmt.Sprintf("%q is not supported", req.Method)}}
+	}
+}
+
+func bindValues(values url.Values) (*query, []*fieldError) {
+	var errs []*fieldError
+	intField := func(field string, dst *int64) {
+		str := strings.TrimSpace(values.Get(field))
+		if str == "" {
+			return
+		}
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			errs = append(errs, &fieldError{Field: field, Message: "must be an integer"})
+			return
+		}
+		*dst = n
+	}
+
+	q := &query{
+		Keywords:     values.Get("q"),
+		Continuation: values.Get("continuation"),
+		searchFilters: searchFilters{
+			Type:              values.Get("type"),
+			VideoDuration:     values.Get("videoDuration"),
+			RegionCode:        values.Get("regionCode"),
+			RelevanceLanguage: values.Get("relevanceLanguage"),
+			SafeSearch:        values.Get("safeSearch"),
+		},
+	}
+	intField("max_per_page", &q.MaxPerPage)
+	intField("max_pages", &q.MaxPages)
+	if str := values.Get("publishedAfter"); str != "" {
+		t, fe := parsePublishedAfter(str)
+		if fe != nil {
+			errs = append(errs, fe)
+		}
+		q.PublishedAfter = t
+	}
+	return q, errs
+}
+
+// parsePublishedAfter accepts RFC 3339 timestamps as well as
+// plain dates, which are what HTML date inputs submit.
+func parsePublishedAfter(str string) (time.Time, *fieldError) {
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", str); err == nil {
+		return t, nil
+	}
+	return time.Time{}, &fieldError{Field: "publishedAfter", Message: "must be an RFC 3339 timestamp or a YYYY-MM-DD date"}
+}
+
+func bindJSON(ctx context.Context, body io.Reader) (*query, []*fieldError) {
+	_, span := trace.StartSpan(ctx, "/parse-json")
+	defer span.End()
+
+	// publishedAfter is decoded as a string, shadowing the query's
+	// time field, so that it's parsed just like in query strings.
+	q := new(query)
+	in := struct {
+		*query
+		PublishedAfter string `json:"publishedAfter"`
+	}{query: q}
+	switch err := json.NewDecoder(body).Decode(&in).(type) {
+	case nil:
+		if in.PublishedAfter == "" {
+			return q, nil
+		}
+		t, fe := parsePublishedAfter(in.PublishedAfter)
+		if fe != nil {
+			return nil, []*fieldError{fe}
+		}
+		q.PublishedAfter = t
+		return q, nil
+	case *json.UnmarshalTypeError:
+		return nil, []*fieldError{{Field: err.Field, Message: "must be of type " + err.Type.String()}}
+	default:
+		if err == io.EOF {
+			return nil, []*fieldError{{Field: "body", Message: "is empty"}}
+		}
+		return nil, []*fieldError{{Field: "body", Message: "must be a JSON object: " + err.Error()}}
+	}
+}
+
+// validate canonicalizes q and returns its invalid fields. Limits of 0
+// are left for setDefaultLimits. Continuations only need to be valid
+// tokens since they carry the rest of the query.
+func (q *query) validate() (errs []*fieldError) {
+	if q.Continuation != "" {
+		return nil
+	}
+	if strings.TrimSpace(q.Keywords) == "" {
+		errs = append(errs, &fieldError{Field: "q", Message: "is required"})
+	}
+	// 0, as when they're left out, stands for the default limits.
+	if q.MaxPerPage < 0 || q.MaxPerPage > maxResultsPerPageLimit {
+		errs = append(errs, &fieldError{Field: "max_per_page", Message: fmt.Sprintf("must be at most %d", maxResultsPerPageLimit)})
+	}
+	if q.MaxPages < 0 || q.MaxPages > maxPagesLimit {
+		errs = append(errs, &fieldError{Field: "max_pages", Message: fmt.Sprintf("must be at most %d", maxPagesLimit)})
+	}
+	return append(errs, q.searchFilters.normalize()...)
+}
+
+// recordValidationFailures records and annotates each invalid field.
+func recordValidationFailures(ctx context.Context, errs []*fieldError) {
+	span := trace.FromContext(ctx)
+	for _, fe := range errs {
+		span.Annotate([]trace.Attribute{
+			trace.StringAttribute("field", fe.Field),
+			trace.StringAttribute("message", fe.Message),
+		}, "Invalid request field")
+		fctx, _ := tag.New(ctx, tag.Upsert(fieldKey, fe.Field))
+		stats.Record(fctx, validationFailures.M(1))
+	}
+}
+
+// writeJSONError responds with err as a JSON object of the form
+// {"error": "...", "fields": [{"field": "...", "message": "..."}]},
+// where fields is only set for validation errors.
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	body := struct {
+		Error  string        `json:"error"`
+		Fields []*fieldError `json:"fields,omitempty"`
+	}{Error: err.Error()}
+	if ve, ok := err.(*validationError); ok {
+		body.Fields = ve.Fields
+	}
+	blob, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_, _ = w.Write(append(blob, '\n'))
+}
+
+var fieldKey tag.Key
+
+var validationFailures = stats.Int64("validation_failures", "the number of invalid request fields", stats.UnitNone)
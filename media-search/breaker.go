@@ -0,0 +1,221 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+
+	"github.com/orijtech/youtube"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+var errBreakerOpen = errors.New("the search provider is unavailable, try again later")
+
+// circuitBreaker stops calls to a failing provider so that searches fail
+// fast instead of each waiting on it. It opens after failureThreshold
+// consecutive failures and, once openTimeout has passed, lets through up
+// to halfOpenProbes calls which close it if they all succeed.
+type circuitBreaker struct {
+	failureThreshold int
+	openTimeout      time.Duration
+	halfOpenProbes   int
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// probes and probeSuccesses count the calls let
+	// through, and those that succeeded, while half-open.
+	probes         int
+	probeSuccesses int
+}
+
+// breaker is set once the provider has been wrapped in a circuit breaker.
+var breaker *circuitBreaker
+
+func newCircuitBreaker(failureThreshold int, openTimeout time.Duration, halfOpenProbes int) *circuitBreaker {
+	if halfOpenProbes < 1 {
+		halfOpenProbes = 1
+	}
+	return &circuitBreaker{
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		halfOpenProbes:   halfOpenProbes,
+		state:            breakerClosed,
+	}
+}
+
+// isOpen reports whether calls are currently being refused.
+func (cb *circuitBreaker) isOpen() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state == breakerOpen && time.Since(cb.openedAt) < cb.openTimeout
+}
+
+// retryAfter is how long until the breaker lets probes through.
+func (cb *circuitBreaker) retryAfter() time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state != breakerOpen {
+		return 0
+	}
+	return cb.openTimeout - time.Since(cb.openedAt)
+}
+
+// allow reports whether a call may go ahead, in which case its
+// outcome must then be passed to done, or the call to release.
+func (cb *circuitBreaker) allow(ctx context.Context) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == breakerOpen {
+		if time.Since(cb.openedAt) < cb.openTimeout {
+			return errBreakerOpen
+		}
+		cb.transitionLocked(ctx, breakerHalfOpen)
+	}
+	if cb.state == breakerHalfOpen {
+		if cb.probes >= cb.halfOpenProbes {
+			return errBreakerOpen
+		}
+		cb.probes++
+	}
+	return nil
+}
+
+func (cb *circuitBreaker) done(ctx context.Context, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerClosed:
+		if err == nil {
+			cb.failures = 0
+			return
+		}
+		cb.failures++
+		if cb.failures >= cb.failureThreshold {
+			cb.transitionLocked(ctx, breakerOpen)
+		}
+
+	case breakerHalfOpen:
+		if err != nil {
+			cb.transitionLocked(ctx, breakerOpen)
+			return
+		}
+		cb.probeSuccesses++
+		if cb.probeSuccesses >= cb.halfOpenProbes {
+			cb.transitionLocked(ctx, breakerClosed)
+		}
+	}
+}
+
+// release gives back a call allowed through that says nothing about
+// the provider's health, so that it neither opens nor closes cb.
+func (cb *circuitBreaker) release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == breakerHalfOpen && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+// transitionLocked must be invoked with cb.mu held.
+func (cb *circuitBreaker) transitionLocked(ctx context.Context, to string) {
+	from := cb.state
+	cb.state = to
+	cb.failures = 0
+	cb.probes = 0
+	cb.probeSuccesses = 0
+	if to == breakerOpen {
+		cb.openedAt = time.Now()
+	}
+
+	trace.FromContext(ctx).Annotate([]trace.Attribute{
+		trace.StringAttribute("from", from),
+		trace.StringAttribute("to", to),
+	}, "Circuit breaker state change")
+	ctx, _ = tag.New(ctx, tag.Upsert(breakerStateKey, to))
+	stats.Record(ctx, breakerTransitions.M(1))
+}
+
+// breakerProvider guards its SearchProvider with a circuit breaker,
+// treating calls that take longer than callTimeout as failures.
+type breakerProvider struct {
+	SearchProvider
+	cb          *circuitBreaker
+	callTimeout time.Duration
+}
+
+var _ SearchProvider = (*breakerProvider)(nil)
+
+func (bp *breakerProvider) Page(ctx context.Context, param *searchParam, pageToken string) (*youtube.SearchPage, string, error) {
+	if err := bp.cb.allow(ctx); err != nil {
+		trace.FromContext(ctx).Annotate(nil, "Circuit breaker is open, not calling the provider")
+		return nil, "", err
+	}
+
+	callCtx := ctx
+	if bp.callTimeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, bp.callTimeout)
+		defer cancel()
+	}
+	page, nextPageToken, err := bp.SearchProvider.Page(callCtx, param, pageToken)
+	if err == nil || isProviderFailure(ctx, err) {
+		bp.cb.done(callCtx, err)
+	} else {
+		bp.cb.release()
+	}
+	return page, nextPageToken, err
+}
+
+// isProviderFailure reports whether err, returned by a call made with
+// ctx, says that the provider is unhealthy: it timed out, couldn't be
+// reached or failed with a 5xx. Errors caused by the search itself, such
+// as a 4xx for a bad region or page token, running out of quota or the
+// caller giving up, say nothing about the provider's health, and
+// shouldn't let a few bad requests open the breaker for everyone.
+func isProviderFailure(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch err := err.(type) {
+	case *googleapi.Error:
+		return err.Code >= 500
+	case net.Error:
+		return true
+	}
+	return err == context.DeadlineExceeded
+}
+
+var breakerStateKey tag.Key
+
+var breakerTransitions = stats.Int64("breaker_transitions", "the number of search provider circuit breaker state changes", stats.UnitNone)
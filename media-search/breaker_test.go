@@ -0,0 +1,62 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/orijtech/youtube"
+)
+
+// erringProvider fails every search with err.
+type erringProvider struct {
+	err error
+}
+
+func (ep *erringProvider) Name() string { return "erring" }
+
+func (ep *erringProvider) Page(ctx context.Context, param *searchParam, pageToken string) (*youtube.SearchPage, string, error) {
+	return nil, "", ep.err
+}
+
+func TestBreakerIgnoresClientErrors(t *testing.T) {
+	tests := []struct {
+		code     int
+		wantOpen bool
+	}{
+		{http.StatusBadRequest, false},
+		{http.StatusNotFound, false},
+		{http.StatusServiceUnavailable, true},
+	}
+	for _, tt := range tests {
+		bp := &breakerProvider{
+			SearchProvider: &erringProvider{err: &googleapi.Error{Code: tt.code}},
+			cb:             newCircuitBreaker(3, time.Minute, 1),
+		}
+		for i := 0; i < 10; i++ {
+			if _, _, err := bp.Page(context.Background(), new(searchParam), ""); err == errBreakerOpen {
+				break
+			}
+		}
+		if open := bp.cb.isOpen(); open != tt.wantOpen {
+			t.Errorf("After a run of %ds: got open %t, want %t", tt.code, open, tt.wantOpen)
+		}
+	}
+}
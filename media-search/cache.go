@@ -0,0 +1,181 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+// ResultCache stores marshaled search results by their canonical cache key.
+type ResultCache interface {
+	// Name identifies the backend in spans and measures.
+	Name() string
+	// Get returns the entry cached for key or errCacheMiss
+	// if there is no such entry or it has expired.
+	Get(ctx context.Context, key string) (*dbCacheKV, error)
+	// Set caches kv under kv.Key, replacing any existing entry, and
+	// expires it after ttl. It sets kv.CacheTime and kv.Expires.
+	Set(ctx context.Context, kv *dbCacheKV, ttl time.Duration) error
+	// Delete removes the entry cached for key if any,
+	// and reports whether there was such an entry.
+	Delete(ctx context.Context, key string) (bool, error)
+	// List describes the unexpired entries whose keys start with prefix.
+	List(ctx context.Context, prefix string) ([]*cacheEntryInfo, error)
+	// DeletePrefix removes the entries whose keys start with prefix,
+	// all of them if it is empty, and returns how many it removed.
+	DeletePrefix(ctx context.Context, prefix string) (int64, error)
+}
+
+// cacheEntryInfo describes a cached entry without its value.
+type cacheEntryInfo struct {
+	Key       string    `json:"key"`
+	Bytes     int       `json:"bytes"`
+	CacheTime time.Time `json:"cached_at"`
+	Expires   time.Time `json:"expires"`
+}
+
+func newCacheEntryInfo(kv *dbCacheKV) *cacheEntryInfo {
+	return &cacheEntryInfo{Key: kv.Key, Bytes: len(kv.Value), CacheTime: kv.CacheTime, Expires: kv.Expires}
+}
+
+var errCacheMiss = errors.New("cache miss")
+
+const (
+	cacheBackendMongo  = "mongo"
+	cacheBackendLRU    = "lru"
+	cacheBackendBadger = "badger"
+	cacheBackendRedis  = "redis"
+)
+
+type cacheConfig struct {
+	backend   string
+	lruSize   int
+	badgerDir string
+	redisAddr string
+}
+
+func newResultCache(cfg *cacheConfig) (ResultCache, error) {
+	var rc ResultCache
+	var err error
+	switch cfg.backend {
+	case cacheBackendMongo:
+		rc, err = newMongoCache(ytSearchesCollection)
+	case cacheBackendLRU:
+		rc, err = newLRUCache(cfg.lruSize)
+	case cacheBackendBadger:
+		rc, err = newBadgerCache(cfg.badgerDir)
+	case cacheBackendRedis:
+		rc, err = newRedisCache(cfg.redisAddr)
+	default:
+		err = fmt.Errorf("unknown cache backend %q", cfg.backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedCache{rc}, nil
+}
+
+// instrumentedCache traces the operations of the ResultCache that it
+// wraps and records their errors, tagged by the backend's name, so that
+// the backends can be compared side by side.
+type instrumentedCache struct {
+	ResultCache
+}
+
+var _ ResultCache = (*instrumentedCache)(nil)
+
+func (ic *instrumentedCache) startSpan(ctx context.Context, name, key string) (context.Context, *trace.Span) {
+	ctx, span := trace.StartSpan(ctx, name)
+	span.AddAttributes(
+		trace.StringAttribute("backend", ic.Name()),
+		trace.StringAttribute("key", key),
+	)
+	ctx, _ = tag.New(ctx, tag.Upsert(cacheBackendKey, ic.Name()))
+	return ctx, span
+}
+
+func (ic *instrumentedCache) Get(ctx context.Context, key string) (*dbCacheKV, error) {
+	ctx, span := ic.startSpan(ctx, "/cache-get", key)
+	defer span.End()
+
+	start := time.Now()
+	kv, err := ic.ResultCache.Get(ctx, key)
+	stats.Record(ctx, cacheLookupLatency.M(sinceMillis(start)))
+	switch err {
+	case nil:
+		span.Annotate([]trace.Attribute{trace.BoolAttribute("hit", true)}, "Cache hit")
+	case errCacheMiss:
+		span.Annotate([]trace.Attribute{trace.BoolAttribute("hit", false)}, "Cache miss")
+	default:
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	return kv, err
+}
+
+func (ic *instrumentedCache) Set(ctx context.Context, kv *dbCacheKV, ttl time.Duration) error {
+	ctx, span := ic.startSpan(ctx, "/cache-set", kv.Key)
+	defer span.End()
+
+	span.AddAttributes(trace.Int64Attribute("bytes", int64(len(kv.Value))))
+	err := ic.ResultCache.Set(ctx, kv, ttl)
+	if err != nil {
+		stats.Record(ctx, cacheInsertionErrors.M(1))
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	return err
+}
+
+func (ic *instrumentedCache) Delete(ctx context.Context, key string) (bool, error) {
+	ctx, span := ic.startSpan(ctx, "/cache-delete", key)
+	defer span.End()
+
+	deleted, err := ic.ResultCache.Delete(ctx, key)
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	span.AddAttributes(trace.BoolAttribute("deleted", deleted))
+	return deleted, err
+}
+
+func (ic *instrumentedCache) List(ctx context.Context, prefix string) ([]*cacheEntryInfo, error) {
+	ctx, span := ic.startSpan(ctx, "/cache-list", prefix)
+	defer span.End()
+
+	entries, err := ic.ResultCache.List(ctx, prefix)
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	span.AddAttributes(trace.Int64Attribute("entries", int64(len(entries))))
+	return entries, err
+}
+
+func (ic *instrumentedCache) DeletePrefix(ctx context.Context, prefix string) (int64, error) {
+	ctx, span := ic.startSpan(ctx, "/cache-delete-prefix", prefix)
+	defer span.End()
+
+	n, err := ic.ResultCache.DeletePrefix(ctx, prefix)
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	span.AddAttributes(trace.Int64Attribute("deleted", n))
+	return n, err
+}
@@ -0,0 +1,147 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// badgerCache caches results in an embedded BadgerDB
+// key-value store, relying on its native entry TTLs.
+type badgerCache struct {
+	db *badger.DB
+}
+
+var _ ResultCache = (*badgerCache)(nil)
+
+func newBadgerCache(dir string) (*badgerCache, error) {
+	opts := badger.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &badgerCache{db: db}, nil
+}
+
+func (bc *badgerCache) Name() string { return cacheBackendBadger }
+
+func (bc *badgerCache) Get(ctx context.Context, key string) (*dbCacheKV, error) {
+	var blob []byte
+	err := bc.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		blob, err = item.ValueCopy(nil)
+		return err
+	})
+	switch err {
+	case nil:
+	case badger.ErrKeyNotFound:
+		return nil, errCacheMiss
+	default:
+		return nil, err
+	}
+
+	kv := new(dbCacheKV)
+	if err := json.Unmarshal(blob, kv); err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+func (bc *badgerCache) Set(ctx context.Context, kv *dbCacheKV, ttl time.Duration) error {
+	kv.CacheTime = time.Now()
+	kv.Expires = kv.CacheTime.Add(ttl)
+	blob, err := json.Marshal(kv)
+	if err != nil {
+		return err
+	}
+	return bc.db.Update(func(txn *badger.Txn) error {
+		return txn.SetWithTTL([]byte(kv.Key), blob, ttl)
+	})
+}
+
+func (bc *badgerCache) Delete(ctx context.Context, key string) (bool, error) {
+	deleted := false
+	err := bc.db.Update(func(txn *badger.Txn) error {
+		switch _, err := txn.Get([]byte(key)); err {
+		case nil:
+		case badger.ErrKeyNotFound:
+			return nil
+		default:
+			return err
+		}
+		deleted = true
+		return txn.Delete([]byte(key))
+	})
+	return deleted && err == nil, err
+}
+
+func (bc *badgerCache) List(ctx context.Context, prefix string) ([]*cacheEntryInfo, error) {
+	var entries []*cacheEntryInfo
+	err := bc.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			blob, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			kv := new(dbCacheKV)
+			if err := json.Unmarshal(blob, kv); err != nil {
+				return err
+			}
+			entries = append(entries, newCacheEntryInfo(kv))
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (bc *badgerCache) DeletePrefix(ctx context.Context, prefix string) (int64, error) {
+	var keys [][]byte
+	err := bc.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, key := range keys {
+		// One transaction per key keeps clear of badger's transaction size limit.
+		if err := bc.db.Update(func(txn *badger.Txn) error { return txn.Delete(key) }); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lruCache is an in-process cache that evicts the least
+// recently used entry once it holds maxEntries entries.
+type lruCache struct {
+	maxEntries int
+
+	mu sync.Mutex
+	// ll is ordered from the most to the least recently used
+	// entry and each of its elements holds a *dbCacheKV.
+	ll      *list.List
+	entries map[string]*list.Element
+}
+
+var _ ResultCache = (*lruCache)(nil)
+
+func newLRUCache(maxEntries int) (*lruCache, error) {
+	if maxEntries <= 0 {
+		return nil, fmt.Errorf("the LRU cache size must be positive, got %d", maxEntries)
+	}
+	return &lruCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		entries:    make(map[string]*list.Element),
+	}, nil
+}
+
+func (lc *lruCache) Name() string { return cacheBackendLRU }
+
+func (lc *lruCache) Get(ctx context.Context, key string) (*dbCacheKV, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	elem, ok := lc.entries[key]
+	if !ok {
+		return nil, errCacheMiss
+	}
+	kv := elem.Value.(*dbCacheKV)
+	if time.Now().After(kv.Expires) {
+		lc.removeElement(elem)
+		return nil, errCacheMiss
+	}
+	lc.ll.MoveToFront(elem)
+	found := *kv
+	return &found, nil
+}
+
+func (lc *lruCache) Set(ctx context.Context, kv *dbCacheKV, ttl time.Duration) error {
+	kv.CacheTime = time.Now()
+	kv.Expires = kv.CacheTime.Add(ttl)
+	// Entries are copied in and out, as the other backends serialize
+	// them, so that callers can neither change nor see changes to them.
+	stored := *kv
+	stored.stale, stored.fromUpstream = false, false
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if elem, ok := lc.entries[kv.Key]; ok {
+		elem.Value = &stored
+		lc.ll.MoveToFront(elem)
+		return nil
+	}
+	lc.entries[kv.Key] = lc.ll.PushFront(&stored)
+	for lc.ll.Len() > lc.maxEntries {
+		lc.removeElement(lc.ll.Back())
+	}
+	return nil
+}
+
+func (lc *lruCache) Delete(ctx context.Context, key string) (bool, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	elem, ok := lc.entries[key]
+	if ok {
+		lc.removeElement(elem)
+	}
+	return ok, nil
+}
+
+func (lc *lruCache) List(ctx context.Context, prefix string) ([]*cacheEntryInfo, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	now := time.Now()
+	var entries []*cacheEntryInfo
+	for elem := lc.ll.Front(); elem != nil; elem = elem.Next() {
+		kv := elem.Value.(*dbCacheKV)
+		if strings.HasPrefix(kv.Key, prefix) && now.Before(kv.Expires) {
+			entries = append(entries, newCacheEntryInfo(kv))
+		}
+	}
+	return entries, nil
+}
+
+func (lc *lruCache) DeletePrefix(ctx context.Context, prefix string) (int64, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	var n int64
+	for elem := lc.ll.Front(); elem != nil; {
+		next := elem.Next()
+		if strings.HasPrefix(elem.Value.(*dbCacheKV).Key, prefix) {
+			lc.removeElement(elem)
+			n++
+		}
+		elem = next
+	}
+	return n, nil
+}
+
+// removeElement must be invoked with lc.mu held.
+func (lc *lruCache) removeElement(elem *list.Element) {
+	lc.ll.Remove(elem)
+	delete(lc.entries, elem.Value.(*dbCacheKV).Key)
+}
@@ -0,0 +1,253 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+
+	"go.opencensus.io/stats"
+)
+
+// mongoCache caches results as documents in a MongoDB collection,
+// one per query with the results embedded, so that the cached
+// results can be queried by their video, channel or title.
+type mongoCache struct {
+	coll *mongo.Collection
+}
+
+// mongoCacheDoc is the document that a mongoCache stores.
+type mongoCacheDoc struct {
+	Key   string        `bson:"key,omitempty"`
+	Pages []*cachedPage `bson:"pages"`
+	// Value holds the marshaled pages of documents cached before
+	// results were structured. Such documents are still read.
+	Value         []byte    `bson:"value,omitempty"`
+	CacheTime     time.Time `bson:"ct,omitempty"`
+	Expires       time.Time `bson:"exp,omitempty"`
+	NextPageToken string    `bson:"npt,omitempty"`
+}
+
+func newMongoCacheDoc(kv *dbCacheKV) (*mongoCacheDoc, error) {
+	pages, err := toCachedPages(kv.Value)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoCacheDoc{
+		Key:           kv.Key,
+		Pages:         pages,
+		CacheTime:     kv.CacheTime,
+		Expires:       kv.Expires,
+		NextPageToken: kv.NextPageToken,
+	}, nil
+}
+
+func (doc *mongoCacheDoc) kv() (*dbCacheKV, error) {
+	kv := &dbCacheKV{
+		Key:           doc.Key,
+		Value:         doc.Value,
+		CacheTime:     doc.CacheTime,
+		Expires:       doc.Expires,
+		NextPageToken: doc.NextPageToken,
+	}
+	// Only documents cached as marshaled blobs have a Value.
+	if doc.Value == nil {
+		var err error
+		if kv.Value, err = fromCachedPages(doc.Pages); err != nil {
+			return nil, err
+		}
+	}
+	return kv, nil
+}
+
+var _ ResultCache = (*mongoCache)(nil)
+
+func newMongoCache(coll *mongo.Collection) (*mongoCache, error) {
+	// Have MongoDB remove entries once they expire.
+	_, err := coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.NewDocument(bson.EC.Int32("exp", 1)),
+		Options: bson.NewDocument(
+			bson.EC.String("name", "exp_ttl"),
+			bson.EC.Int32("expireAfterSeconds", 0),
+		),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Ensure that concurrent cache misses for the same query can't insert duplicate entries.
+	_, err = coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.NewDocument(bson.EC.Int32("key", 1)),
+		Options: bson.NewDocument(
+			bson.EC.String("name", "key_unique"),
+			bson.EC.Boolean("unique", true),
+		),
+	})
+	if err != nil {
+		// This fails if entries from before keys were canonical
+		// are duplicated, but then the cache still works.
+		log.Printf("Failed to create the unique cache key index: %v", err)
+	}
+
+	// And allow looking up cached results by what they contain.
+	for _, field := range []string{"pages.items.video_id", "pages.items.channel_id"} {
+		_, err = coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+			Keys:    bson.NewDocument(bson.EC.Int32(field, 1)),
+			Options: bson.NewDocument(bson.EC.String("name", field)),
+		})
+		if err != nil {
+			log.Printf("Failed to create the %q cache index: %v", field, err)
+		}
+	}
+	_, err = coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.NewDocument(bson.EC.String("pages.items.title", "text")),
+		Options: bson.NewDocument(bson.EC.String("name", "pages.items.title_text")),
+	})
+	if err != nil {
+		log.Printf("Failed to create the cached title text index: %v", err)
+	}
+	return &mongoCache{coll: coll}, nil
+}
+
+func (mc *mongoCache) Name() string { return cacheBackendMongo }
+
+func keyFilter(key string) *bson.Document {
+	return bson.NewDocument(bson.EC.String("key", key))
+}
+
+func (mc *mongoCache) Get(ctx context.Context, key string) (*dbCacheKV, error) {
+	doc := new(mongoCacheDoc)
+	switch err := mc.coll.FindOne(ctx, keyFilter(key)).Decode(doc); err {
+	case nil:
+	case bson.ErrElementNotFound, mongo.ErrNoDocuments:
+		return nil, errCacheMiss
+	default:
+		stats.Record(ctx, mongoErrors.M(1))
+		return nil, err
+	}
+
+	if reflect.DeepEqual(doc, blankMongoCacheDoc) {
+		// A false cache hit!
+		return nil, errCacheMiss
+	}
+	// MongoDB's TTL monitor only runs periodically
+	// so expired entries can linger for a while.
+	if !doc.Expires.IsZero() && time.Now().After(doc.Expires) {
+		return nil, errCacheMiss
+	}
+	return doc.kv()
+}
+
+var blankMongoCacheDoc = new(mongoCacheDoc)
+
+func (mc *mongoCache) Set(ctx context.Context, kv *dbCacheKV, ttl time.Duration) error {
+	kv.CacheTime = time.Now()
+	kv.Expires = kv.CacheTime.Add(ttl)
+	doc, err := newMongoCacheDoc(kv)
+	if err != nil {
+		return err
+	}
+	_, err = mc.coll.InsertOne(ctx, doc)
+	if !isDuplicateKeyError(err) {
+		return err
+	}
+	// Otherwise the entry exists already, so replace it,
+	// which also converts entries cached as blobs.
+	_, err = mc.coll.ReplaceOne(ctx, keyFilter(kv.Key), doc)
+	return err
+}
+
+func (mc *mongoCache) Delete(ctx context.Context, key string) (bool, error) {
+	res, err := mc.coll.DeleteOne(ctx, keyFilter(key))
+	if err != nil {
+		stats.Record(ctx, mongoErrors.M(1))
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+func prefixFilter(prefix string) *bson.Document {
+	if prefix == "" {
+		return bson.NewDocument()
+	}
+	return bson.NewDocument(bson.EC.Regex("key", "^"+regexp.QuoteMeta(prefix), ""))
+}
+
+func (mc *mongoCache) List(ctx context.Context, prefix string) ([]*cacheEntryInfo, error) {
+	cur, err := mc.coll.Find(ctx, prefixFilter(prefix))
+	if err != nil {
+		stats.Record(ctx, mongoErrors.M(1))
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	now := time.Now()
+	var entries []*cacheEntryInfo
+	for cur.Next(ctx) {
+		doc := new(mongoCacheDoc)
+		if err := cur.Decode(doc); err != nil {
+			return nil, err
+		}
+		if !doc.Expires.IsZero() && !now.Before(doc.Expires) {
+			continue
+		}
+		kv, err := doc.kv()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, newCacheEntryInfo(kv))
+	}
+	if err := cur.Err(); err != nil {
+		stats.Record(ctx, mongoErrors.M(1))
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (mc *mongoCache) DeletePrefix(ctx context.Context, prefix string) (int64, error) {
+	res, err := mc.coll.DeleteMany(ctx, prefixFilter(prefix))
+	if err != nil {
+		stats.Record(ctx, mongoErrors.M(1))
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// upsert applies update to the document in coll matching filter or,
+// if there is none yet, inserts doc, which is how it should first be.
+// If a concurrent upsert inserts it first, update is applied after all.
+func upsert(ctx context.Context, coll *mongo.Collection, filter, update *bson.Document, doc interface{}) error {
+	res, err := coll.UpdateOne(ctx, filter, update)
+	if err != nil || res.MatchedCount > 0 {
+		return err
+	}
+	_, err = coll.InsertOne(ctx, doc)
+	if isDuplicateKeyError(err) {
+		_, err = coll.UpdateOne(ctx, filter, update)
+	}
+	return err
+}
+
+func isDuplicateKeyError(err error) bool {
+	// E11000 is MongoDB's duplicate key error code.
+	return err != nil && strings.Contains(err.Error(), "E11000")
+}
@@ -0,0 +1,131 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// redisCachePrefix namespaces the cache's keys in a shared Redis server.
+const redisCachePrefix = "media-search:cache:"
+
+// redisCache caches results in Redis, relying on its key expiry.
+type redisCache struct {
+	client *redis.Client
+}
+
+var _ ResultCache = (*redisCache)(nil)
+
+func newRedisCache(addr string) (*redisCache, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping().Err(); err != nil {
+		return nil, err
+	}
+	return &redisCache{client: client}, nil
+}
+
+func (rc *redisCache) Name() string { return cacheBackendRedis }
+
+func (rc *redisCache) Get(ctx context.Context, key string) (*dbCacheKV, error) {
+	blob, err := rc.client.WithContext(ctx).Get(redisCachePrefix + key).Bytes()
+	switch err {
+	case nil:
+	case redis.Nil:
+		return nil, errCacheMiss
+	default:
+		return nil, err
+	}
+
+	kv := new(dbCacheKV)
+	if err := json.Unmarshal(blob, kv); err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+func (rc *redisCache) Set(ctx context.Context, kv *dbCacheKV, ttl time.Duration) error {
+	kv.CacheTime = time.Now()
+	kv.Expires = kv.CacheTime.Add(ttl)
+	blob, err := json.Marshal(kv)
+	if err != nil {
+		return err
+	}
+	return rc.client.WithContext(ctx).Set(redisCachePrefix+kv.Key, blob, ttl).Err()
+}
+
+func (rc *redisCache) Delete(ctx context.Context, key string) (bool, error) {
+	n, err := rc.client.WithContext(ctx).Del(redisCachePrefix + key).Result()
+	return n > 0, err
+}
+
+// redisGlobEscaper escapes the characters that are special in SCAN patterns.
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// scanKeys returns the Redis keys of the entries whose keys start with prefix.
+func (rc *redisCache) scanKeys(ctx context.Context, prefix string) ([]string, error) {
+	client := rc.client.WithContext(ctx)
+	match := redisGlobEscaper.Replace(redisCachePrefix+prefix) + "*"
+	var keys []string
+	var cursor uint64
+	for {
+		batch, next, err := client.Scan(cursor, match, 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if next == 0 {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+func (rc *redisCache) List(ctx context.Context, prefix string) ([]*cacheEntryInfo, error) {
+	keys, err := rc.scanKeys(ctx, prefix)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	values, err := rc.client.WithContext(ctx).MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	var entries []*cacheEntryInfo
+	for _, value := range values {
+		// Entries that expired since the scan come back as nil.
+		blob, ok := value.(string)
+		if !ok {
+			continue
+		}
+		kv := new(dbCacheKV)
+		if err := json.Unmarshal([]byte(blob), kv); err != nil {
+			return nil, err
+		}
+		entries = append(entries, newCacheEntryInfo(kv))
+	}
+	return entries, nil
+}
+
+func (rc *redisCache) DeletePrefix(ctx context.Context, prefix string) (int64, error) {
+	keys, err := rc.scanKeys(ctx, prefix)
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	return rc.client.WithContext(ctx).Del(keys...).Result()
+}
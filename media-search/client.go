@@ -12,29 +12,101 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// +build ignore
+
 package main
 
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	xray "github.com/census-instrumentation/opencensus-go-exporter-aws"
 	"go.opencensus.io/exporter/stackdriver"
+	"go.opencensus.io/plugin/ocgrpc"
 	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
 
 	"github.com/orijtech/otils"
 	"github.com/orijtech/youtube"
 )
 
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputCSV  = "csv"
+)
+
+var (
+	transport   string
+	grpcAddr    string
+	serverURL   string
+	maxPages    int64
+	maxPerPage  int64
+	output      string
+	oneShot     string
+	batchFile   string
+	concurrency int
+	filters     searchFilters
+)
+
+// searchFilters restrict the results of a search, with
+// the values of the YouTube Data API's parameters.
+type searchFilters struct {
+	Type              string
+	PublishedAfter    string
+	VideoDuration     string
+	RegionCode        string
+	RelevanceLanguage string
+	SafeSearch        string
+}
+
 func init() {
+	flag.StringVar(&transport, "transport", "http", "the transport to search over, either \"http\" or \"grpc\"")
+	flag.StringVar(&grpcAddr, "grpc-addr", "localhost:9779", "the address of the MediaSearch gRPC service")
+	flag.StringVar(&serverURL, "server", otils.EnvOrAlternates("MEDIA_SEARCH_SERVER_URL", "http://localhost:9778"),
+		"the URL of the media-search HTTP server")
+	flag.Int64Var(&maxPages, "max-pages", 0, "the maximum number of pages per search, the server's default if 0")
+	flag.Int64Var(&maxPerPage, "max-per-page", 0, "the maximum number of results per page, the server's default if 0")
+	flag.StringVar(&output, "output", outputText, "the output format, one of \"text\", \"json\" or \"csv\"")
+	flag.StringVar(&oneShot, "q", "", "search for this query once and exit instead of reading queries from stdin")
+	flag.StringVar(&batchFile, "batch", "", "search concurrently for each query, one per line, in this file and exit")
+	flag.IntVar(&concurrency, "concurrency", 4, "the number of concurrent searches in batch mode")
+	flag.StringVar(&filters.Type, "type", "", "restrict results to a \"video\", \"channel\" or \"playlist\"")
+	flag.StringVar(&filters.PublishedAfter, "published-after", "",
+		"restrict results to those published after this date, as YYYY-MM-DD or RFC 3339")
+	flag.StringVar(&filters.VideoDuration, "video-duration", "",
+		"restrict videos to \"short\", \"medium\" or \"long\" ones, which requires -type=video")
+	flag.StringVar(&filters.RegionCode, "region", "", "search in the region with this ISO 3166-1 alpha-2 country code")
+	flag.StringVar(&filters.RelevanceLanguage, "lang", "", "prefer results in the language with this ISO 639-1 code")
+	flag.StringVar(&filters.SafeSearch, "safe-search", "", "one of \"moderate\", \"none\" or \"strict\"")
+	flag.Parse()
+
+	if filters.PublishedAfter != "" {
+		if t, err := time.Parse("2006-01-02", filters.PublishedAfter); err == nil {
+			filters.PublishedAfter = t.Format(time.RFC3339)
+		} else if _, err := time.Parse(time.RFC3339, filters.PublishedAfter); err != nil {
+			log.Fatalf("Invalid -published-after %q, expecting YYYY-MM-DD or RFC 3339", filters.PublishedAfter)
+		}
+	}
+
 	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
 	xe, err := xray.NewExporter(xray.WithVersion("latest"))
 	if err != nil {
@@ -50,58 +122,437 @@ func init() {
 	if err := view.Register(ochttp.DefaultClientViews...); err != nil {
 		log.Fatalf("Failed to register views: %v", err)
 	}
+	if err := view.Register(ocgrpc.DefaultClientViews...); err != nil {
+		log.Fatalf("Failed to register views: %v", err)
+	}
+}
+
+// searchRequest is a search for Query or, if
+// Continuation is set, for the page after a previous one.
+type searchRequest struct {
+	Query        string
+	Continuation string
+	MaxPages     int64
+	MaxPerPage   int64
+	Filters      searchFilters
+}
+
+// result is a single search result, whichever transport it arrived over.
+type result struct {
+	VideoID     string `json:"video_id,omitempty"`
+	ChannelID   string `json:"channel_id,omitempty"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+func (r *result) url() string {
+	switch {
+	case r.VideoID != "":
+		return "https://youtu.be/" + r.VideoID
+	case r.ChannelID != "":
+		return "https://www.youtube.com/channel/" + r.ChannelID
+	default:
+		return ""
+	}
 }
 
+// searcher runs req, invoking onResult with each result as soon as it
+// arrives, and returns the continuation token if there are more pages.
+type searcher func(ctx context.Context, req *searchRequest, onResult func(*result)) (continuation string, err error)
+
 func main() {
-	client := &http.Client{}
+	var search searcher
+	switch transport {
+	case "http":
+		search = httpSearcher(&http.Client{}, strings.TrimSuffix(serverURL, "/")+"/search")
+	case "grpc":
+		conn, err := grpc.Dial(grpcAddr, grpc.WithInsecure(), grpc.WithStatsHandler(new(ocgrpc.ClientHandler)))
+		if err != nil {
+			log.Fatalf("Failed to dial %q: %v", grpcAddr, err)
+		}
+		defer conn.Close()
+		search = grpcSearcher(NewMediaSearchClient(conn))
+	default:
+		log.Fatalf("Unknown transport %q", transport)
+	}
+
+	pr, err := newPrinter(os.Stdout, output)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var queries []string
+	switch {
+	case oneShot != "":
+		queries = []string{oneShot}
+	case batchFile != "":
+		if queries, err = readQueries(batchFile); err != nil {
+			log.Fatalf("Failed to read the batch file: %v", err)
+		}
+	default:
+		interactive(search, pr)
+		return
+	}
+
+	timings := runBatch(search, pr, queries)
+	printSummary(os.Stderr, timings)
+	for _, t := range timings {
+		if t.err != nil {
+			os.Exit(1)
+		}
+	}
+}
+
+// interactive reads queries from stdin until it is closed, printing
+// each one's results as they arrive. Entering "more" after a query
+// that has more pages retrieves the next page.
+func interactive(search searcher, pr *printer) {
 	br := bufio.NewReader(os.Stdin)
+	// continuation is the token of the page after
+	// the last ones printed, if there are more.
+	continuation := ""
+	lastQuery := ""
 	for {
-		fmt.Printf("Content to search$ ")
+		if continuation != "" {
+			fmt.Fprintf(os.Stderr, "Content to search (or \"more\" for the next page)$ ")
+		} else {
+			fmt.Fprintf(os.Stderr, "Content to search$ ")
+		}
 		input, _, err := br.ReadLine()
+		if err == io.EOF {
+			return
+		}
 		if err != nil {
 			log.Fatalf("Failed to read input: %v", err)
 		}
-		inBlob, err := json.Marshal(map[string]string{
-			"q": string(input),
+		req := &searchRequest{Query: string(input), MaxPages: maxPages, MaxPerPage: maxPerPage, Filters: filters}
+		if req.Query == "more" && continuation != "" {
+			req = &searchRequest{Continuation: continuation}
+		} else {
+			lastQuery = req.Query
+		}
+
+		start := time.Now()
+		n := 0
+		continuation, err = search(context.Background(), req, func(res *result) {
+			n++
+			pr.print(lastQuery, res)
 		})
+		pr.flush()
 		if err != nil {
-			log.Fatalf("Failed to json.Marshal input blob: %v", err)
+			log.Printf("Error encountered: %v", err)
+			continue
 		}
-		req, err := http.NewRequest("POST", "http://localhost:9778/search", bytes.NewReader(inBlob))
-		if err != nil {
-			log.Fatalf("Failed to build POST request: %v", err)
+		log.Printf("%d results in %s", n, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// queryTiming is the outcome of a single query in a batch.
+type queryTiming struct {
+	query   string
+	results int
+	latency time.Duration
+	err     error
+}
+
+// runBatch searches for queries with up to concurrency searches in
+// flight. Each query's results are printed together once it's done
+// so that the output of concurrent queries isn't interleaved.
+func runBatch(search searcher, pr *printer, queries []string) []*queryTiming {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	timings := make([]*queryTiming, len(queries))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				var results []*result
+				start := time.Now()
+				_, err := search(context.Background(), &searchRequest{
+					Query:      queries[i],
+					MaxPages:   maxPages,
+					MaxPerPage: maxPerPage,
+					Filters:    filters,
+				}, func(res *result) { results = append(results, res) })
+				timings[i] = &queryTiming{query: queries[i], results: len(results), latency: time.Since(start), err: err}
+				if err != nil {
+					log.Printf("Query %q failed: %v", queries[i], err)
+				}
+				pr.printAll(queries[i], results)
+			}
+		}()
+	}
+	for i := range queries {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return timings
+}
+
+// readQueries reads one query per line from path,
+// skipping blank lines and #-prefixed comments.
+func readQueries(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var queries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		queries = append(queries, line)
+	}
+	return queries, scanner.Err()
+}
+
+func printSummary(w io.Writer, timings []*queryTiming) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "QUERY\tRESULTS\tLATENCY\tERROR")
+	var latencies []time.Duration
+	for _, t := range timings {
+		errMsg := "-"
+		if t.err != nil {
+			errMsg = t.err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", t.query, t.results, t.latency.Round(time.Millisecond), errMsg)
+		latencies = append(latencies, t.latency)
+	}
+	tw.Flush()
+	if len(latencies) < 2 {
+		return
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))].Round(time.Millisecond)
+	}
+	fmt.Fprintf(w, "\n%d queries: min %s, p50 %s, p90 %s, max %s\n", len(latencies),
+		percentile(0), percentile(0.5), percentile(0.9), percentile(1))
+}
+
+// printer writes results in the chosen output format. It is safe for
+// concurrent use and JSON output is a line-delimited object per result.
+type printer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	csvw   *csv.Writer
+}
+
+func newPrinter(w io.Writer, format string) (*printer, error) {
+	pr := &printer{w: w, format: format}
+	switch format {
+	case outputText, outputJSON:
+	case outputCSV:
+		pr.csvw = csv.NewWriter(w)
+		if err := pr.csvw.Write([]string{"query", "url", "title", "description"}); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+	return pr, nil
+}
+
+func (pr *printer) print(query string, res *result) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.printLocked(query, res)
+}
+
+func (pr *printer) printAll(query string, results []*result) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	for _, res := range results {
+		pr.printLocked(query, res)
+	}
+	pr.flushLocked()
+}
+
+func (pr *printer) printLocked(query string, res *result) {
+	switch pr.format {
+	case outputJSON:
+		blob, _ := json.Marshal(struct {
+			Query string `json:"query"`
+			URL   string `json:"url"`
+			*result
+		}{query, res.url(), res})
+		fmt.Fprintf(pr.w, "%s\n", blob)
+	case outputCSV:
+		_ = pr.csvw.Write([]string{query, res.url(), res.Title, res.Description})
+	default:
+		if res.VideoID != "" {
+			fmt.Fprintf(pr.w, "URL: %s\n", res.url())
+		} else if res.ChannelID != "" {
+			fmt.Fprintf(pr.w, "ChannelURL: %s\n", res.url())
+		}
+		fmt.Fprintf(pr.w, "Title: %s\nDescription: %s\n\n\n", res.Title, res.Description)
+	}
+}
+
+func (pr *printer) flush() {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.flushLocked()
+}
+
+func (pr *printer) flushLocked() {
+	if pr.csvw != nil {
+		pr.csvw.Flush()
+	}
+}
+
+// httpSearcher returns a searcher that POSTs to searchURL
+// and reads the results as they're streamed back.
+func httpSearcher(client *http.Client, searchURL string) searcher {
+	return func(ctx context.Context, sreq *searchRequest, onResult func(*result)) (string, error) {
+		body := make(map[string]interface{})
+		if sreq.Continuation != "" {
+			body["continuation"] = sreq.Continuation
+		} else {
+			body["q"] = sreq.Query
+			if sreq.MaxPages > 0 {
+				body["max_pages"] = sreq.MaxPages
+			}
+			if sreq.MaxPerPage > 0 {
+				body["max_per_page"] = sreq.MaxPerPage
+			}
+			for key, value := range map[string]string{
+				"type":              sreq.Filters.Type,
+				"publishedAfter":    sreq.Filters.PublishedAfter,
+				"videoDuration":     sreq.Filters.VideoDuration,
+				"regionCode":        sreq.Filters.RegionCode,
+				"relevanceLanguage": sreq.Filters.RelevanceLanguage,
+				"safeSearch":        sreq.Filters.SafeSearch,
+			} {
+				if value != "" {
+					body[key] = value
+				}
+			}
 		}
-		res, err := client.Do(req)
+		inBlob, err := json.Marshal(body)
 		if err != nil {
-			log.Fatalf("Failed to POST: %v", err)
+			return "", err
 		}
-		outBlob, err := ioutil.ReadAll(res.Body)
-		_ = res.Body.Close()
-		if !otils.StatusOK(res.StatusCode) {
-			log.Printf("Error encountered: statusCode: %d message: %s", res.StatusCode, outBlob)
-			continue
+		req, err := http.NewRequest("POST", searchURL, bytes.NewReader(inBlob))
+		if err != nil {
+			return "", err
 		}
+		// Ask for the pages to be streamed so that they
+		// can be printed as soon as each one arrives.
+		req.Header.Set("Accept", "application/x-ndjson")
+		res, err := client.Do(req.WithContext(ctx))
 		if err != nil {
-			log.Fatalf("Failed to read res.Body: %v", err)
+			return "", err
 		}
-		var pages []*youtube.SearchPage
-		if err := json.Unmarshal(outBlob, &pages); err != nil {
-			log.Fatalf("Unmarshaling responses: %v", err)
+		defer res.Body.Close()
+		if !otils.StatusOK(res.StatusCode) {
+			outBlob, _ := ioutil.ReadAll(res.Body)
+			return "", fmt.Errorf("statusCode: %d message: %s", res.StatusCode, bytes.TrimSpace(outBlob))
 		}
-		for _, page := range pages {
+		return readStreamedPages(res.Body, func(page *youtube.SearchPage) {
 			for _, video := range page.Items {
 				if video == nil {
 					continue
 				}
-				snippet := video.Snippet
-				if video.Id.VideoId != "" {
-					fmt.Printf("URL: https://youtu.be/%s\n", video.Id.VideoId)
-				} else if video.Id.ChannelId != "" {
-					fmt.Printf("ChannelURL: https://www.youtube.com/channel/%s\n",
-						video.Id.ChannelId)
+				res := new(result)
+				if video.Id != nil {
+					res.VideoID, res.ChannelID = video.Id.VideoId, video.Id.ChannelId
 				}
-				fmt.Printf("Title: %s\nDescription: %s\n\n\n", snippet.Title, snippet.Description)
+				if video.Snippet != nil {
+					res.Title, res.Description = video.Snippet.Title, video.Snippet.Description
+				}
+				onResult(res)
+			}
+		})
+	}
+}
+
+// grpcSearcher returns a searcher that calls MediaSearch.Search.
+func grpcSearcher(client MediaSearchClient) searcher {
+	return func(ctx context.Context, sreq *searchRequest, onResult func(*result)) (string, error) {
+		stream, err := client.Search(ctx, &SearchRequest{
+			Query:        sreq.Query,
+			MaxPages:     sreq.MaxPages,
+			MaxPerPage:   sreq.MaxPerPage,
+			Continuation: sreq.Continuation,
+			Filters: &SearchFilters{
+				Type:              sreq.Filters.Type,
+				PublishedAfter:    sreq.Filters.PublishedAfter,
+				VideoDuration:     sreq.Filters.VideoDuration,
+				RegionCode:        sreq.Filters.RegionCode,
+				RelevanceLanguage: sreq.Filters.RelevanceLanguage,
+				SafeSearch:        sreq.Filters.SafeSearch,
+			},
+		})
+		if err != nil {
+			return "", err
+		}
+		continuation := ""
+		for {
+			page, err := stream.Recv()
+			if err == io.EOF {
+				return continuation, nil
 			}
+			if err != nil {
+				return "", err
+			}
+			if page.Continuation != "" {
+				continuation = page.Continuation
+			}
+			for _, item := range page.Items {
+				onResult(&result{
+					VideoID:     item.VideoId,
+					ChannelID:   item.ChannelId,
+					Title:       item.Title,
+					Description: item.Description,
+				})
+			}
+		}
+	}
+}
+
+// readStreamedPages invokes onPage with each page of an NDJSON stream
+// of results as soon as it has been read, and returns the stream's
+// continuation token if there are more pages.
+func readStreamedPages(r io.Reader, onPage func(*youtube.SearchPage)) (continuation string, err error) {
+	dec := json.NewDecoder(r)
+	for {
+		var line json.RawMessage
+		if err := dec.Decode(&line); err != nil {
+			if err == io.EOF {
+				return continuation, nil
+			}
+			return "", err
+		}
+
+		control := new(struct {
+			Error        string `json:"error"`
+			Continuation string `json:"continuation"`
+		})
+		if err := json.Unmarshal(line, control); err == nil {
+			if control.Error != "" {
+				return "", errors.New(control.Error)
+			}
+			if control.Continuation != "" {
+				continuation = control.Continuation
+				continue
+			}
+		}
+		page := new(youtube.SearchPage)
+		if err := json.Unmarshal(line, page); err != nil {
+			return "", fmt.Errorf("unmarshaling page: %v", err)
 		}
+		onPage(page)
 	}
 }
@@ -0,0 +1,124 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/trace"
+)
+
+// coalescer ensures that concurrent callers asking for the same key
+// share a single in-flight upstream call instead of each making their own.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	wg sync.WaitGroup
+	// spanContext identifies the span of the in-flight call
+	// so that the callers waiting on it can link to it.
+	spanContext trace.SpanContext
+
+	value *dbCacheKV
+	err   error
+}
+
+var searchGroup = &coalescer{calls: make(map[string]*coalescedCall)}
+
+// Do invokes fn for key unless a call for key is already in flight, in
+// which case it waits for that call and returns its results instead.
+// shared reports whether the results came from another caller's call.
+func (c *coalescer) Do(ctx context.Context, key string, fn func(context.Context) (*dbCacheKV, error)) (value *dbCacheKV, err error, shared bool) {
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		return c.wait(ctx, call)
+	}
+
+	// The call is shared so it mustn't be cut short
+	// when the request that started it is cancelled.
+	ctx, span := trace.StartSpan(detachedContext{ctx}, "/coalesced-upstream-call")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	call := &coalescedCall{spanContext: span.SpanContext()}
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		// Even if fn panics, the waiters must be released and later
+		// callers for key must start a call of their own.
+		r := recover()
+		if r != nil {
+			call.value, call.err = nil, fmt.Errorf("the upstream call panicked: %v", r)
+		}
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		call.wg.Done()
+		if r != nil {
+			panic(r)
+		}
+	}()
+
+	call.value, call.err = fn(ctx)
+	return call.value, call.err, false
+}
+
+func (c *coalescer) wait(ctx context.Context, call *coalescedCall) (*dbCacheKV, error, bool) {
+	span := trace.FromContext(ctx)
+	span.AddLink(trace.Link{
+		TraceID:    call.spanContext.TraceID,
+		SpanID:     call.spanContext.SpanID,
+		Type:       trace.LinkTypeUnspecified,
+		Attributes: map[string]interface{}{"reason": "coalesced"},
+	})
+	span.Annotate(nil, "Waiting on an in-flight upstream call for the same query")
+	stats.Record(ctx, coalescedRequests.M(1))
+
+	doneChan := make(chan struct{})
+	go func() {
+		call.wg.Wait()
+		close(doneChan)
+	}()
+	select {
+	case <-doneChan:
+		return call.value, call.err, true
+	case <-ctx.Done():
+		return nil, ctx.Err(), true
+	}
+}
+
+// detachedContext carries the values of its parent, such as
+// the current span and tags, but not its deadline or cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+var _ context.Context = detachedContext{}
+
+func (dc detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (dc detachedContext) Done() <-chan struct{}             { return nil }
+func (dc detachedContext) Err() error                        { return nil }
+func (dc detachedContext) Value(key interface{}) interface{} { return dc.parent.Value(key) }
+
+var coalescedRequests = stats.Int64("coalesced_requests", "the number of requests that waited on an in-flight upstream call", stats.UnitNone)
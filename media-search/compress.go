@@ -0,0 +1,226 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// The content codings that responses may be compressed with.
+const (
+	encodingBrotli   = "br"
+	encodingGzip     = "gzip"
+	encodingIdentity = "identity"
+)
+
+var encodingKey tag.Key
+
+// negotiateEncoding picks the content coding for a response from the
+// request's Accept-Encoding header, preferring brotli to gzip when
+// both are equally acceptable, or encodingIdentity if neither is.
+func negotiateEncoding(acceptEncoding string) string {
+	best, bestQ := encodingIdentity, 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, q := parseCoding(part)
+		switch coding {
+		case encodingBrotli:
+			if q > 0 && q >= bestQ {
+				best, bestQ = coding, q
+			}
+		case encodingGzip, "x-gzip":
+			if q > 0 && q > bestQ {
+				best, bestQ = encodingGzip, q
+			}
+		}
+	}
+	return best
+}
+
+// parseCoding parses an Accept-Encoding element like "gzip;q=0.8".
+func parseCoding(part string) (coding string, q float64) {
+	params := strings.Split(part, ";")
+	coding = strings.ToLower(strings.TrimSpace(params[0]))
+	q = 1
+	for _, param := range params[1:] {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "q=") {
+			if f, err := strconv.ParseFloat(param[len("q="):], 64); err == nil {
+				q = f
+			}
+		}
+	}
+	return coding, q
+}
+
+// isCompressible reports whether responses of contentType are worth compressing.
+func isCompressible(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", mediaType == "application/x-ndjson",
+		mediaType == "application/javascript", mediaType == "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// compressHandler compresses the responses of next with the content coding
+// negotiated from each request and records their sizes before and after.
+func compressHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding")),
+			isHEAD:         r.Method == "HEAD",
+		}
+		defer cw.close(r.Context())
+		next.ServeHTTP(cw, r)
+	})
+}
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter decides whether to compress the response once its
+// headers are known and then writes the body through the encoder.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	isHEAD   bool
+
+	wroteHeader bool
+	enc         flushWriteCloser
+	// rawBytes and encodedBytes count the body before and after compression.
+	rawBytes     int64
+	encodedBytes int64
+}
+
+var _ http.Flusher = (*compressWriter)(nil)
+var _ http.Hijacker = (*compressWriter)(nil)
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+
+	h := cw.Header()
+	// Bodiless, partial and already encoded responses are left alone.
+	compress := cw.encoding != encodingIdentity && !cw.isHEAD &&
+		code != http.StatusNoContent && code != http.StatusNotModified && code != http.StatusPartialContent &&
+		h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+		isCompressible(h.Get("Content-Type"))
+	if !compress {
+		cw.encoding = encodingIdentity
+	} else {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+		// The representation differs from the uncompressed one.
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		counter := &countingWriter{w: cw.ResponseWriter, n: &cw.encodedBytes}
+		if cw.encoding == encodingBrotli {
+			cw.enc = brotli.NewWriterLevel(counter, 5)
+		} else {
+			cw.enc, _ = gzip.NewWriterLevel(counter, gzip.DefaultCompression)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	cw.rawBytes += int64(len(b))
+	if cw.enc == nil {
+		n, err := cw.ResponseWriter.Write(b)
+		cw.encodedBytes += int64(n)
+		return n, err
+	}
+	return cw.enc.Write(b)
+}
+
+// Flush writes out what has been compressed so far, so
+// that streamed pages reach clients as soon as they arrive.
+func (cw *compressWriter) Flush() {
+	if cw.enc != nil {
+		_ = cw.enc.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer doesn't support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+func (cw *compressWriter) close(ctx context.Context) {
+	if cw.enc != nil {
+		_ = cw.enc.Close()
+	}
+	if !cw.wroteHeader || cw.rawBytes == 0 {
+		return
+	}
+	ctx, _ = tag.New(ctx, tag.Upsert(encodingKey, cw.encoding))
+	stats.Record(ctx, responseBytes.M(cw.rawBytes), responseEncodedBytes.M(cw.encodedBytes))
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	*c.n += int64(n)
+	return n, err
+}
+
+// responseSizeDistribution buckets response
+// sizes by powers of 4 from 256B up to 16MiB.
+var responseSizeDistribution = view.Distribution(0, 256, 1<<10, 4<<10, 16<<10, 64<<10, 256<<10, 1<<20, 4<<20, 16<<20)
+
+var (
+	responseBytes        = stats.Int64("response_bytes", "the size of response bodies before compression", stats.UnitBytes)
+	responseEncodedBytes = stats.Int64("response_encoded_bytes", "the size of response bodies after compression", stats.UnitBytes)
+)
@@ -0,0 +1,61 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// resultETag is the entity tag of the response for kv. It is derived
+// from the cached value, and the token for the page after it, so it
+// only changes when the results do. It is weak since the compressed
+// and uncompressed representations of the results share it.
+func resultETag(kv *dbCacheKV) string {
+	h := sha256.New()
+	h.Write(kv.Value)
+	h.Write([]byte{0})
+	h.Write([]byte(kv.NextPageToken))
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatches reports whether the If-None-Match header ifNoneMatch
+// matches etag, using the weak comparison that RFC 7232 requires.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// resultCacheControl lets clients cache the response for kv for as
+// long as the server will treat it as fresh. Stale results must be
+// revalidated since they are being refreshed.
+func resultCacheControl(kv *dbCacheKV) string {
+	remaining := cacheTTL - time.Since(kv.CacheTime)
+	if kv.stale || remaining <= 0 {
+		return "no-cache"
+	}
+	return fmt.Sprintf("public, max-age=%d", int64(remaining/time.Second))
+}
@@ -0,0 +1,156 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	ytv3 "google.golang.org/api/youtube/v3"
+)
+
+// searchFilters restrict the results of a search. Their JSON
+// names and values are those of the YouTube Data API's.
+type searchFilters struct {
+	// Type is one of "video", "channel" or "playlist".
+	Type string `json:"type,omitempty"`
+	// PublishedAfter restricts results to those published after it.
+	PublishedAfter time.Time `json:"publishedAfter,omitempty"`
+	// VideoDuration is one of "any", "short", "medium" or "long"
+	// and requires Type to be "video".
+	VideoDuration string `json:"videoDuration,omitempty"`
+	// RegionCode is an ISO 3166-1 alpha-2 country code.
+	RegionCode string `json:"regionCode,omitempty"`
+	// RelevanceLanguage is an ISO 639-1 language code.
+	RelevanceLanguage string `json:"relevanceLanguage,omitempty"`
+	// SafeSearch is one of "moderate", "none" or "strict".
+	SafeSearch string `json:"safeSearch,omitempty"`
+}
+
+var (
+	filterTypes          = []string{"video", "channel", "playlist"}
+	filterVideoDurations = []string{"any", "short", "medium", "long"}
+	filterSafeSearches   = []string{"moderate", "none", "strict"}
+)
+
+func oneOf(field, value string, allowed []string) *fieldError {
+	if value == "" {
+		return nil
+	}
+	for _, a := range allowed {
+		if value == a {
+			return nil
+		}
+	}
+	return &fieldError{Field: field, Message: fmt.Sprintf("must be one of %q", allowed)}
+}
+
+// normalize canonicalizes the filters, so that equivalent ones
+// share a cache key, and then returns any that are invalid.
+func (sf *searchFilters) normalize() (errs []*fieldError) {
+	sf.Type = strings.ToLower(strings.TrimSpace(sf.Type))
+	sf.VideoDuration = strings.ToLower(strings.TrimSpace(sf.VideoDuration))
+	sf.RegionCode = strings.ToUpper(strings.TrimSpace(sf.RegionCode))
+	sf.RelevanceLanguage = strings.ToLower(strings.TrimSpace(sf.RelevanceLanguage))
+	sf.SafeSearch = strings.ToLower(strings.TrimSpace(sf.SafeSearch))
+	if !sf.PublishedAfter.IsZero() {
+		sf.PublishedAfter = sf.PublishedAfter.UTC().Truncate(time.Second)
+	}
+
+	for _, fe := range []*fieldError{
+		oneOf("type", sf.Type, filterTypes),
+		oneOf("videoDuration", sf.VideoDuration, filterVideoDurations),
+		oneOf("safeSearch", sf.SafeSearch, filterSafeSearches),
+	} {
+		if fe != nil {
+			errs = append(errs, fe)
+		}
+	}
+	if sf.VideoDuration != "" && sf.Type != "video" {
+		errs = append(errs, &fieldError{Field: "videoDuration", Message: `requires type to be "video"`})
+	}
+	if sf.RegionCode != "" && len(sf.RegionCode) != 2 {
+		errs = append(errs, &fieldError{Field: "regionCode", Message: "must be a two letter country code"})
+	}
+	return errs
+}
+
+// addTo adds the set filters to the cache key values.
+func (sf *searchFilters) addTo(values url.Values) {
+	set := func(key, value string) {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	set("type", sf.Type)
+	if !sf.PublishedAfter.IsZero() {
+		set("published_after", sf.PublishedAfter.Format(time.RFC3339))
+	}
+	set("video_duration", sf.VideoDuration)
+	set("region_code", sf.RegionCode)
+	set("relevance_language", sf.RelevanceLanguage)
+	set("safe_search", sf.SafeSearch)
+}
+
+// apply sets the filters on a YouTube Data API search.
+func (sf *searchFilters) apply(call *ytv3.SearchListCall) *ytv3.SearchListCall {
+	if sf.Type != "" {
+		call = call.Type(sf.Type)
+	}
+	if !sf.PublishedAfter.IsZero() {
+		call = call.PublishedAfter(sf.PublishedAfter.Format(time.RFC3339))
+	}
+	if sf.VideoDuration != "" {
+		call = call.VideoDuration(sf.VideoDuration)
+	}
+	if sf.RegionCode != "" {
+		call = call.RegionCode(sf.RegionCode)
+	}
+	if sf.RelevanceLanguage != "" {
+		call = call.RelevanceLanguage(sf.RelevanceLanguage)
+	}
+	if sf.SafeSearch != "" {
+		call = call.SafeSearch(sf.SafeSearch)
+	}
+	return call
+}
+
+// filtersFromProto converts the filters of a MediaSearch gRPC request.
+func filtersFromProto(pf *SearchFilters) (searchFilters, *fieldError) {
+	sf := searchFilters{
+		Type:              pf.GetType(),
+		VideoDuration:     pf.GetVideoDuration(),
+		RegionCode:        pf.GetRegionCode(),
+		RelevanceLanguage: pf.GetRelevanceLanguage(),
+		SafeSearch:        pf.GetSafeSearch(),
+	}
+	if s := pf.GetPublishedAfter(); s != "" {
+		t, fe := parsePublishedAfter(s)
+		if fe != nil {
+			return sf, fe
+		}
+		sf.PublishedAfter = t
+	}
+	return sf, nil
+}
+
+// matches reports whether a search result of kind, such as
+// "youtube#video", passes the Type filter. The other filters
+// need metadata that search results don't carry.
+func (sf *searchFilters) matches(kind string) bool {
+	return sf.Type == "" || kind == "youtube#"+sf.Type
+}
@@ -0,0 +1,207 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"go.opencensus.io/plugin/ocgrpc"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	"github.com/orijtech/youtube"
+	ytv3 "google.golang.org/api/youtube/v3"
+)
+
+// grpcServer serves the MediaSearch service off the
+// same cache and provider as the HTTP handlers.
+type grpcServer struct{}
+
+var _ MediaSearchServer = (*grpcServer)(nil)
+
+// serveGRPC serves the MediaSearch service on addr until it fails.
+func serveGRPC(addr string) error {
+	if err := view.Register(ocgrpc.DefaultServerViews...); err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := grpc.NewServer(grpc.StatsHandler(new(ocgrpc.ServerHandler)))
+	RegisterMediaSearchServer(srv, new(grpcServer))
+	reflection.Register(srv)
+	log.Printf("Serving gRPC on %q", addr)
+	return srv.Serve(ln)
+}
+
+func (gs *grpcServer) Search(req *SearchRequest, stream MediaSearch_SearchServer) error {
+	start := time.Now()
+	ctx, span := trace.StartSpan(stream.Context(), "/grpc-search")
+	defer span.End()
+
+	filters, fe := filtersFromProto(req.Filters)
+	q := &query{
+		Keywords:      req.Query,
+		MaxPerPage:    req.MaxPerPage,
+		MaxPages:      req.MaxPages,
+		searchFilters: filters,
+		Continuation:  req.Continuation,
+	}
+	if err := validateGRPC(ctx, q, fe); err != nil {
+		return err
+	}
+	q.setDefaultLimits()
+	if q.Continuation != "" {
+		var err error
+		if q, err = q.resolveContinuation(); err != nil {
+			return validateGRPC(ctx, q, &fieldError{Field: "continuation", Message: "is invalid"})
+		}
+		span.Annotate([]trace.Attribute{
+			trace.StringAttribute("page_token", q.pageToken),
+		}, "Continuing from a previous response")
+	}
+
+	// Pages are sent as soon as they arrive, unless they're
+	// cached or another caller is fetching them already.
+	var sendErr error
+	onPage := func(page *youtube.SearchPage) {
+		if sendErr == nil {
+			sendErr = stream.Send(toSearchPage(page))
+		}
+	}
+	kv, streamed, err := lookupOrFetch(ctx, q, onPage)
+	switch err {
+	case errQuotaExhausted:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errBreakerOpen:
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if kv.stale {
+		_ = stream.SetHeader(metadata.Pairs("warning", `110 - "Response is Stale"`))
+	}
+	if !streamed {
+		var pages []*youtube.SearchPage
+		if err := json.Unmarshal(kv.Value, &pages); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		for _, page := range pages {
+			onPage(page)
+		}
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+	items := countItems(kv.Value)
+	recordSearch(ctx, grpcUserID(ctx), q.Keywords, items)
+	recordSearchServed(ctx, kv, items, start)
+
+	if token := q.continuationToken(kv.NextPageToken); token != "" {
+		return stream.Send(&SearchPage{Continuation: token})
+	}
+	return nil
+}
+
+func (gs *grpcServer) InvalidateCache(ctx context.Context, req *InvalidateCacheRequest) (*InvalidateCacheResponse, error) {
+	ctx, span := trace.StartSpan(ctx, "/grpc-invalidate-cache")
+	defer span.End()
+
+	filters, fe := filtersFromProto(req.Filters)
+	q := &query{Keywords: req.Query, MaxPerPage: req.MaxPerPage, MaxPages: req.MaxPages, searchFilters: filters}
+	if err := validateGRPC(ctx, q, fe); err != nil {
+		return nil, err
+	}
+	q.setDefaultLimits()
+	key := q.cacheKey()
+	span.AddAttributes(trace.StringAttribute("key", key))
+	if _, err := resultCache.Delete(ctx, key); err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &InvalidateCacheResponse{Key: key}, nil
+}
+
+// validateGRPC validates q, along with fe if it is a conversion error, and
+// records any invalid fields. It returns an InvalidArgument status if so.
+func validateGRPC(ctx context.Context, q *query, fe *fieldError) error {
+	var errs []*fieldError
+	if fe != nil {
+		errs = append(errs, fe)
+	} else if q != nil {
+		errs = q.validate()
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	recordValidationFailures(ctx, errs)
+	return status.Error(codes.InvalidArgument, (&validationError{Fields: errs}).Error())
+}
+
+// grpcUserID is the gRPC counterpart of userID,
+// using the x-media-search-userid metadata key.
+func grpcUserID(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, id := range md.Get("x-media-search-userid") {
+		if id = strings.TrimSpace(id); id != "" {
+			return id
+		}
+	}
+	return "anonymous"
+}
+
+func toSearchPage(page *youtube.SearchPage) *SearchPage {
+	out := new(SearchPage)
+	for _, item := range page.Items {
+		if item == nil {
+			continue
+		}
+		out.Items = append(out.Items, toSearchResult(item))
+	}
+	return out
+}
+
+func toSearchResult(item *ytv3.SearchResult) *SearchResult {
+	res := new(SearchResult)
+	if id := item.Id; id != nil {
+		res.Kind = id.Kind
+		res.VideoId = id.VideoId
+		res.ChannelId = id.ChannelId
+		res.PlaylistId = id.PlaylistId
+	}
+	if sn := item.Snippet; sn != nil {
+		res.Title = sn.Title
+		res.Description = sn.Description
+		res.ChannelTitle = sn.ChannelTitle
+		res.PublishedAt = sn.PublishedAt
+		if sn.Thumbnails != nil && sn.Thumbnails.Default != nil {
+			res.ThumbnailURL = sn.Thumbnails.Default.Url
+		}
+	}
+	return res
+}
@@ -0,0 +1,340 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+var (
+	// searchHistoryCollection holds a document for every search made.
+	searchHistoryCollection *mongo.Collection
+	// queryStatsCollection holds a document per normalized query with
+	// the number of times it was searched for, found results and when.
+	queryStatsCollection *mongo.Collection
+)
+
+// historyRetention is how long searches are kept in the history.
+const historyRetention = 30 * 24 * time.Hour
+
+type searchEvent struct {
+	UserID    string    `bson:"user"`
+	Query     string    `bson:"q"`
+	Timestamp time.Time `bson:"ts"`
+}
+
+type queryStats struct {
+	Query     string    `json:"q" bson:"q"`
+	Hits      int64     `json:"hits" bson:"hits"`
+	Successes int64     `json:"successes" bson:"successes"`
+	FirstSeen time.Time `json:"first_seen" bson:"first_seen"`
+	LastSeen  time.Time `json:"last_seen" bson:"last_seen"`
+}
+
+func setupHistory(db *mongo.Database) {
+	searchHistoryCollection = db.Collection("search_history")
+	queryStatsCollection = db.Collection("query_stats")
+
+	indices := []struct {
+		coll  *mongo.Collection
+		model mongo.IndexModel
+	}{
+		{
+			searchHistoryCollection, mongo.IndexModel{
+				Keys: bson.NewDocument(bson.EC.Int32("ts", 1)),
+				Options: bson.NewDocument(
+					bson.EC.String("name", "ts_ttl"),
+					bson.EC.Int32("expireAfterSeconds", int32(historyRetention/time.Second)),
+				),
+			},
+		}, {
+			searchHistoryCollection, mongo.IndexModel{
+				Keys:    bson.NewDocument(bson.EC.Int32("user", 1), bson.EC.Int32("ts", -1)),
+				Options: bson.NewDocument(bson.EC.String("name", "user_ts")),
+			},
+		}, {
+			queryStatsCollection, mongo.IndexModel{
+				Keys: bson.NewDocument(bson.EC.Int32("q", 1)),
+				Options: bson.NewDocument(
+					bson.EC.String("name", "q_unique"),
+					bson.EC.Boolean("unique", true),
+				),
+			},
+		},
+	}
+	for _, index := range indices {
+		if _, err := index.coll.Indexes().CreateOne(context.Background(), index.model); err != nil {
+			log.Printf("Failed to create a search history index: %v", err)
+		}
+	}
+}
+
+// userID identifies the user making req by the X-MEDIA-SEARCH-USERID
+// header, falling back to the media_search_user cookie and then to
+// "anonymous" for requests that identify no user.
+func userID(req *http.Request) string {
+	if id, ok := identifiedUserID(req); ok {
+		return id
+	}
+	return "anonymous"
+}
+
+var errNoUserID = errors.New("the X-MEDIA-SEARCH-USERID header or media_search_user cookie is required")
+
+// identifiedUserID is like userID but reports whether req identified its
+// user at all, for the routes whose data belongs to a single user.
+func identifiedUserID(req *http.Request) (string, bool) {
+	if id := strings.TrimSpace(req.Header.Get("X-MEDIA-SEARCH-USERID")); id != "" {
+		return id, true
+	}
+	if cookie, err := req.Cookie("media_search_user"); err == nil && cookie.Value != "" {
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+// recordSearch adds a search by user for keywords, which found items
+// results, to the history and bumps the query's hit count, along with
+// its success count if it found anything. It records in the background,
+// so that the search isn't slowed down, in a span linked to ctx's.
+func recordSearch(ctx context.Context, user, keywords string, items int64) {
+	if searchHistoryCollection == nil {
+		// The server is running without MongoDB.
+		return
+	}
+	parentSC := trace.FromContext(ctx).SpanContext()
+	bgCtx := tag.NewContext(context.Background(), tag.FromContext(ctx))
+	go func() {
+		ctx, span := trace.StartSpan(bgCtx, "/record-search")
+		defer span.End()
+		span.AddLink(trace.Link{
+			TraceID: parentSC.TraceID,
+			SpanID:  parentSC.SpanID,
+			Type:    trace.LinkTypeParent,
+		})
+
+		now := time.Now()
+		normalized := normalizeKeywords(keywords)
+		event := &searchEvent{UserID: user, Query: normalized, Timestamp: now}
+		if _, err := searchHistoryCollection.InsertOne(ctx, event); err != nil {
+			stats.Record(ctx, mongoErrors.M(1), historyInsertionErrors.M(1))
+			span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+		}
+		if err := bumpQueryStats(ctx, normalized, items > 0, now); err != nil {
+			stats.Record(ctx, mongoErrors.M(1), historyInsertionErrors.M(1))
+			span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+		}
+	}()
+}
+
+func bumpQueryStats(ctx context.Context, normalized string, succeeded bool, now time.Time) error {
+	var successes int64
+	if succeeded {
+		successes = 1
+	}
+	filter := bson.NewDocument(bson.EC.String("q", normalized))
+	update := bson.NewDocument(
+		bson.EC.SubDocumentFromElements("$inc", bson.EC.Int64("hits", 1), bson.EC.Int64("successes", successes)),
+		bson.EC.SubDocumentFromElements("$set", bson.EC.Time("last_seen", now)),
+	)
+
+	return upsert(ctx, queryStatsCollection, filter, update, &queryStats{
+		Query:     normalized,
+		Hits:      1,
+		Successes: successes,
+		FirstSeen: now,
+		LastSeen:  now,
+	})
+}
+
+func intParam(req *http.Request, key string, alt, max int64) int64 {
+	n, err := strconv.ParseInt(req.URL.Query().Get(key), 10, 64)
+	if err != nil || n <= 0 {
+		return alt
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+type historyEntry struct {
+	Query        string    `json:"q" bson:"_id"`
+	Count        int64     `json:"count" bson:"count"`
+	LastSearched time.Time `json:"last_searched" bson:"last"`
+}
+
+// history responds with the requesting user's most recent distinct queries.
+func history(w http.ResponseWriter, r *http.Request) {
+	ctx, span := trace.StartSpan(r.Context(), "/history")
+	defer span.End()
+
+	ctx, _ = tag.New(ctx, tag.Upsert(endpointKey, "history"))
+	stats.Record(ctx, historyRequests.M(1))
+
+	user, ok := identifiedUserID(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, errNoUserID)
+		return
+	}
+	limit := intParam(r, "limit", 20, 100)
+	span.AddAttributes(
+		trace.StringAttribute("user", user),
+		trace.Int64Attribute("limit", limit),
+	)
+
+	pipeline := bson.NewArray(
+		bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("$match", bson.EC.String("user", user))),
+		bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("$group",
+			bson.EC.String("_id", "$q"),
+			bson.EC.SubDocumentFromElements("count", bson.EC.Int64("$sum", 1)),
+			bson.EC.SubDocumentFromElements("last", bson.EC.String("$max", "$ts")),
+		)),
+		bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("$sort", bson.EC.Int32("last", -1))),
+		bson.VC.DocumentFromElements(bson.EC.Int64("$limit", limit)),
+	)
+
+	entries := make([]*historyEntry, 0, limit)
+	if err := aggregate(ctx, searchHistoryCollection, pipeline, func(cur mongo.Cursor) error {
+		entry := new(historyEntry)
+		if err := cur.Decode(entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	}); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+type trendingEntry struct {
+	Query string `json:"q" bson:"_id"`
+	Count int64  `json:"count" bson:"count"`
+}
+
+// trending responds with the most searched for queries within the
+// window given by the "window" parameter e.g. "window=1h".
+func trending(w http.ResponseWriter, r *http.Request) {
+	ctx, span := trace.StartSpan(r.Context(), "/trending")
+	defer span.End()
+
+	ctx, _ = tag.New(ctx, tag.Upsert(endpointKey, "trending"))
+	stats.Record(ctx, historyRequests.M(1))
+
+	window := time.Hour
+	if str := r.URL.Query().Get("window"); str != "" {
+		var err error
+		if window, err = time.ParseDuration(str); err != nil || window <= 0 {
+			errs := []*fieldError{{Field: "window", Message: "must be a positive duration such as 1h"}}
+			recordValidationFailures(ctx, errs)
+			writeJSONError(w, http.StatusBadRequest, &validationError{Fields: errs})
+			return
+		}
+	}
+	limit := intParam(r, "limit", 10, 100)
+	span.AddAttributes(
+		trace.StringAttribute("window", window.String()),
+		trace.Int64Attribute("limit", limit),
+	)
+
+	pipeline := bson.NewArray(
+		bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("$match",
+			bson.EC.SubDocumentFromElements("ts", bson.EC.Time("$gte", time.Now().Add(-window))),
+		)),
+		bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("$group",
+			bson.EC.String("_id", "$q"),
+			bson.EC.SubDocumentFromElements("count", bson.EC.Int64("$sum", 1)),
+		)),
+		bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("$sort", bson.EC.Int32("count", -1))),
+		bson.VC.DocumentFromElements(bson.EC.Int64("$limit", limit)),
+	)
+
+	entries := make([]*trendingEntry, 0, limit)
+	if err := aggregate(ctx, searchHistoryCollection, pipeline, func(cur mongo.Cursor) error {
+		entry := new(trendingEntry)
+		if err := cur.Decode(entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	}); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// aggregate runs pipeline against coll and invokes fn with the cursor
+// positioned at each result in turn.
+func aggregate(ctx context.Context, coll *mongo.Collection, pipeline *bson.Array, fn func(mongo.Cursor) error) error {
+	ctx, span := trace.StartSpan(ctx, "/mongo-aggregate")
+	defer span.End()
+
+	cur, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		stats.Record(ctx, mongoErrors.M(1))
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		if err := fn(cur); err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		stats.Record(ctx, mongoErrors.M(1))
+		return err
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus responds with code and v as JSON. The headers are
+// set before the status is written, as they're ignored afterwards.
+func writeJSONStatus(w http.ResponseWriter, code int, v interface{}) {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(blob)
+}
+
+var (
+	historyRequests        = stats.Int64("history_requests", "the number of search history and trending requests", stats.UnitNone)
+	historyInsertionErrors = stats.Int64("history_insertion_errors", "the number of errors recording searches", stats.UnitNone)
+)
@@ -0,0 +1,87 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// The sources that search results are served from.
+const (
+	sourceCache    = "cache"
+	sourceUpstream = "upstream"
+)
+
+var sourceKey tag.Key
+
+var (
+	// latencyDistribution buckets latencies in milliseconds from 1ms to 10s.
+	latencyDistribution = view.Distribution(0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000)
+	// itemsDistribution buckets the number of results in a response.
+	itemsDistribution = view.Distribution(0, 1, 5, 10, 20, 50, 100, 200, 500)
+)
+
+func (kv *dbCacheKV) source() string {
+	if kv.fromUpstream {
+		return sourceUpstream
+	}
+	return sourceCache
+}
+
+// sinceMillis returns the milliseconds elapsed since start.
+func sinceMillis(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
+
+// recordSearchServed records how long a search that started at start
+// took end to end, and the size of its results, tagged by their source.
+func recordSearchServed(ctx context.Context, kv *dbCacheKV, items int64, start time.Time) {
+	ctx, _ = tag.New(ctx, tag.Upsert(sourceKey, kv.source()))
+	stats.Record(ctx,
+		searchLatency.M(sinceMillis(start)),
+		searchPayloadBytes.M(int64(len(kv.Value))),
+		searchResultItems.M(items),
+	)
+}
+
+// countItems counts the results in the marshaled pages of blob,
+// without unmarshaling the results themselves.
+func countItems(blob []byte) int64 {
+	var pages []struct {
+		Items []json.RawMessage
+	}
+	if err := json.Unmarshal(blob, &pages); err != nil {
+		return 0
+	}
+	var n int64
+	for _, page := range pages {
+		n += int64(len(page.Items))
+	}
+	return n
+}
+
+var (
+	searchLatency        = stats.Float64("search_latency", "the end to end latency of searches", "ms")
+	cacheLookupLatency   = stats.Float64("cache_lookup_latency", "the latency of cache lookups", "ms")
+	upstreamFetchLatency = stats.Float64("upstream_fetch_latency", "the latency of fetching results from the search provider", "ms")
+	searchPayloadBytes   = stats.Int64("search_payload_bytes", "the size of the marshaled results of searches", stats.UnitBytes)
+	searchResultItems    = stats.Int64("search_result_items", "the number of results that searches return", stats.UnitNone)
+)
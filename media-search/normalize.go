@@ -0,0 +1,56 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// removeStopWords is whether normalization drops stop words.
+var removeStopWords bool
+
+// stopWords are the English words that barely change
+// what a search finds and so are dropped if removeStopWords.
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "by": true, "for": true, "from": true, "how": true, "in": true,
+	"is": true, "it": true, "of": true, "on": true, "or": true, "that": true,
+	"the": true, "this": true, "to": true, "was": true, "what": true, "with": true,
+}
+
+// normalizeKeywords normalizes keywords so that equivalent queries share
+// a cache key and an upstream call. It applies Unicode NFKC normalization,
+// so that e.g. full-width letters match their ASCII forms, folds their case,
+// collapses their whitespace and, if removeStopWords, drops stop words unless
+// the keywords are nothing but stop words.
+func normalizeKeywords(keywords string) string {
+	folded := cases.Fold().String(norm.NFKC.String(keywords))
+	words := strings.Fields(folded)
+	if removeStopWords {
+		kept := make([]string, 0, len(words))
+		for _, word := range words {
+			if !stopWords[word] {
+				kept = append(kept, word)
+			}
+		}
+		if len(kept) > 0 {
+			words = kept
+		}
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,197 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	gat "google.golang.org/api/googleapi/transport"
+	ytv3 "google.golang.org/api/youtube/v3"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+
+	"github.com/orijtech/youtube"
+)
+
+// SearchProvider retrieves pages of search results from an upstream source.
+type SearchProvider interface {
+	// Name identifies the provider in spans and measures.
+	Name() string
+	// Page retrieves the page of results for param at pageToken, where ""
+	// is the first page. It also returns the token of the page after it,
+	// which is "" if there are no more pages.
+	Page(ctx context.Context, param *searchParam, pageToken string) (*youtube.SearchPage, string, error)
+}
+
+// searchParam is a youtube.SearchParam along with
+// the filters that it doesn't have fields for.
+type searchParam struct {
+	youtube.SearchParam
+	searchFilters
+}
+
+const (
+	providerYouTube = "youtube"
+	providerFixture = "fixture"
+)
+
+func newSearchProvider(name, fixturesDir string) (SearchProvider, error) {
+	switch name {
+	case providerYouTube:
+		return newYouTubeProvider(os.Getenv("YOUTUBE_API_KEY"))
+	case providerFixture:
+		return &fixtureProvider{dir: fixturesDir}, nil
+	default:
+		return nil, fmt.Errorf("unknown search provider %q", name)
+	}
+}
+
+// youtubeProvider searches the YouTube Data API. It uses the API
+// directly, rather than through youtube.Client, so that it can
+// resume from the page token handed out in continuation tokens.
+type youtubeProvider struct {
+	svc *ytv3.Service
+}
+
+var _ SearchProvider = (*youtubeProvider)(nil)
+
+func newYouTubeProvider(apiKey string) (*youtubeProvider, error) {
+	svc, err := ytv3.New(&http.Client{
+		Transport: &ochttp.Transport{Base: &gat.APIKey{Key: apiKey}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &youtubeProvider{svc: svc}, nil
+}
+
+func (yp *youtubeProvider) Name() string { return providerYouTube }
+
+func (yp *youtubeProvider) Page(ctx context.Context, param *searchParam, pageToken string) (*youtube.SearchPage, string, error) {
+	call := yp.svc.Search.List("id,snippet").Q(param.Query)
+	if param.MaxResultsPerPage > 0 {
+		call = call.MaxResults(int64(param.MaxResultsPerPage))
+	}
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+	call = param.searchFilters.apply(call)
+	res, err := call.Context(ctx).Do()
+	if err != nil {
+		return nil, "", err
+	}
+	return &youtube.SearchPage{Items: res.Items}, res.NextPageToken, nil
+}
+
+// fixtureProvider serves canned result pages from a directory of JSON
+// files so that the demo can run without network access or an API key.
+// Each file holds a JSON array of pages, in the same format that /search
+// responds with, and is named after the lowercased keywords with spaces
+// replaced by dashes e.g. "look-alive.json". Queries without their own
+// fixture are served from "default.json" if present. Page tokens are
+// simply the indices of the pages in the file.
+type fixtureProvider struct {
+	dir string
+}
+
+var _ SearchProvider = (*fixtureProvider)(nil)
+
+func (fp *fixtureProvider) Name() string { return providerFixture }
+
+// fixtureName returns the name of the fixture for keywords, or "" if
+// the name would reach outside the fixtures directory.
+func fixtureName(keywords string) string {
+	name := strings.Replace(normalizeKeywords(keywords), " ", "-", -1)
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return ""
+	}
+	return name + ".json"
+}
+
+// readFixture reads the fixture with the name, as long as it is within
+// the fixtures directory, and returns its contents and path.
+func (fp *fixtureProvider) readFixture(name string) ([]byte, string, error) {
+	if name == "" {
+		return nil, "", &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	dir := filepath.Clean(fp.dir)
+	path := filepath.Join(dir, name)
+	if rel, err := filepath.Rel(dir, path); err != nil || rel != filepath.Base(path) {
+		return nil, "", fmt.Errorf("fixture %q is outside of %q", name, fp.dir)
+	}
+	blob, err := ioutil.ReadFile(path)
+	return blob, path, err
+}
+
+func (fp *fixtureProvider) Page(ctx context.Context, param *searchParam, pageToken string) (*youtube.SearchPage, string, error) {
+	_, span := trace.StartSpan(ctx, "/fixture-search")
+	defer span.End()
+
+	index := 0
+	if pageToken != "" {
+		var err error
+		if index, err = strconv.Atoi(pageToken); err != nil || index < 0 {
+			return nil, "", fmt.Errorf("invalid fixture page token %q", pageToken)
+		}
+	}
+
+	blob, path, err := fp.readFixture(fixtureName(param.Query))
+	if os.IsNotExist(err) {
+		blob, path, err = fp.readFixture("default.json")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute("fixture", path),
+		trace.Int64Attribute("page", int64(index)),
+	}, "Loaded fixture")
+
+	var pages []*youtube.SearchPage
+	if err := json.Unmarshal(blob, &pages); err != nil {
+		return nil, "", fmt.Errorf("parsing fixture %q: %v", path, err)
+	}
+	if index >= len(pages) || pages[index] == nil {
+		return new(youtube.SearchPage), "", nil
+	}
+
+	page := pages[index]
+	if param.Type != "" {
+		var items []*ytv3.SearchResult
+		for _, item := range page.Items {
+			if item != nil && item.Id != nil && param.matches(item.Id.Kind) {
+				items = append(items, item)
+			}
+		}
+		page.Items = items
+	}
+	if param.MaxResultsPerPage > 0 && uint64(len(page.Items)) > param.MaxResultsPerPage {
+		page.Items = page.Items[:param.MaxResultsPerPage]
+	}
+	nextPageToken := ""
+	if index+1 < len(pages) {
+		nextPageToken = strconv.Itoa(index + 1)
+	}
+	return page, nextPageToken, nil
+}
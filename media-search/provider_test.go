@@ -0,0 +1,58 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/orijtech/youtube"
+)
+
+func TestFixtureTraversalFallsBackToDefault(t *testing.T) {
+	root, err := ioutil.TempDir("", "media-search-fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "fixtures")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFixture := func(path, title string) {
+		blob := `[{"items": [{"id": {"kind": "youtube#video", "videoId": "dQw4w9WgXcQ"}, "snippet": {"title": "` + title + `"}}]}]`
+		if err := ioutil.WriteFile(path, []byte(blob), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFixture(filepath.Join(dir, "default.json"), "default")
+	writeFixture(filepath.Join(root, "secret.json"), "secret")
+
+	fp := &fixtureProvider{dir: dir}
+	for _, q := range []string{"../secret", "..", "a/../../secret", `..\secret`} {
+		page, _, err := fp.Page(context.Background(), &searchParam{SearchParam: youtube.SearchParam{Query: q}}, "")
+		if err != nil {
+			t.Errorf("%q: %v", q, err)
+			continue
+		}
+		if len(page.Items) != 1 || page.Items[0].Snippet.Title != "default" {
+			t.Errorf("%q: got %+v, want the default fixture", q, page.Items)
+		}
+	}
+}
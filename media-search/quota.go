@@ -0,0 +1,163 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/trace"
+
+	"github.com/orijtech/youtube"
+)
+
+// searchListCost is the number of quota units that
+// each YouTube Data API search.list request costs.
+const searchListCost = 100
+
+var errQuotaExhausted = errors.New("the daily YouTube API quota is nearly exhausted, try again later")
+
+// quotaAccountant tracks how much of the daily YouTube Data API quota has
+// been spent. The quota resets at midnight Pacific time, like the API's.
+// It only knows about this process's spending, so the budget should be
+// split between replicas.
+type quotaAccountant struct {
+	budget int64
+	// reserve is how many units are held back once the quota is nearly
+	// exhausted, so that only cached results are served from then on.
+	reserve int64
+
+	mu    sync.Mutex
+	spent int64
+	// resetsAt is when the current day's quota resets.
+	resetsAt time.Time
+}
+
+// quota is nil unless the provider consumes the YouTube API quota.
+var quota *quotaAccountant
+
+// pacific is the time zone of the YouTube API's quota day.
+var pacific = loadPacific()
+
+func loadPacific() *time.Location {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		log.Printf("Failed to load the Pacific time zone, assuming UTC-8: %v", err)
+		return time.FixedZone("PST", -8*60*60)
+	}
+	return loc
+}
+
+// nextPacificMidnight returns the first midnight Pacific time after t.
+func nextPacificMidnight(t time.Time) time.Time {
+	t = t.In(pacific)
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, pacific)
+}
+
+func newQuotaAccountant(budget, reserve int64) *quotaAccountant {
+	qa := &quotaAccountant{
+		budget:   budget,
+		reserve:  reserve,
+		resetsAt: nextPacificMidnight(time.Now()),
+	}
+	stats.Record(context.Background(), youtubeQuotaRemaining.M(budget))
+	go qa.resetDaily()
+	return qa
+}
+
+// resetDaily resets the quota at every Pacific midnight so that
+// the remaining quota gauge is correct even when there's no traffic.
+func (qa *quotaAccountant) resetDaily() {
+	for {
+		qa.mu.Lock()
+		wait := time.Until(qa.resetsAt)
+		qa.mu.Unlock()
+
+		time.Sleep(wait)
+		qa.mu.Lock()
+		qa.maybeResetLocked(time.Now())
+		qa.mu.Unlock()
+	}
+}
+
+// maybeResetLocked must be invoked with qa.mu held.
+func (qa *quotaAccountant) maybeResetLocked(now time.Time) {
+	if now.Before(qa.resetsAt) {
+		return
+	}
+	qa.spent = 0
+	qa.resetsAt = nextPacificMidnight(now)
+	stats.Record(context.Background(), youtubeQuotaRemaining.M(qa.budget))
+	log.Printf("Reset the YouTube API quota, the next reset is at %s", qa.resetsAt)
+}
+
+// charge spends units of the quota unless that would exceed the budget.
+func (qa *quotaAccountant) charge(ctx context.Context, units int64) error {
+	qa.mu.Lock()
+	defer qa.mu.Unlock()
+
+	qa.maybeResetLocked(time.Now())
+	if qa.spent+units > qa.budget {
+		return errQuotaExhausted
+	}
+	qa.spent += units
+	stats.Record(ctx, youtubeQuotaRemaining.M(qa.budget-qa.spent))
+	return nil
+}
+
+// nearlyExhausted reports whether only the reserve is left, in which
+// case searches that would consume quota should be turned away.
+func (qa *quotaAccountant) nearlyExhausted() bool {
+	qa.mu.Lock()
+	defer qa.mu.Unlock()
+
+	qa.maybeResetLocked(time.Now())
+	return qa.budget-qa.spent <= qa.reserve
+}
+
+// retryAfter is how long until the quota resets.
+func (qa *quotaAccountant) retryAfter() time.Duration {
+	qa.mu.Lock()
+	defer qa.mu.Unlock()
+	return time.Until(qa.resetsAt)
+}
+
+// quotaProvider charges each page retrieved from its
+// SearchProvider against the YouTube API quota.
+type quotaProvider struct {
+	SearchProvider
+	qa *quotaAccountant
+}
+
+var _ SearchProvider = (*quotaProvider)(nil)
+
+func (qp *quotaProvider) Page(ctx context.Context, param *searchParam, pageToken string) (*youtube.SearchPage, string, error) {
+	if err := qp.qa.charge(ctx, searchListCost); err != nil {
+		trace.FromContext(ctx).Annotate([]trace.Attribute{
+			trace.Int64Attribute("cost", searchListCost),
+		}, "Out of YouTube API quota")
+		return nil, "", err
+	}
+	return qp.SearchProvider.Page(ctx, param, pageToken)
+}
+
+var (
+	youtubeQuotaRemaining = stats.Int64("youtube_quota_remaining", "the units left of the daily YouTube API quota", stats.UnitNone)
+	quotaRejections       = stats.Int64("quota_rejections", "the number of searches refused for lack of YouTube API quota", stats.UnitNone)
+)
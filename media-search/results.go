@@ -0,0 +1,192 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+
+	ytv3 "google.golang.org/api/youtube/v3"
+
+	"github.com/orijtech/youtube"
+)
+
+// cachedResult is a search result as it is stored in MongoDB, with every
+// field of the result and the fields that cached results are looked up by.
+type cachedResult struct {
+	// Kind is the kind of resource found e.g. "youtube#video".
+	Kind       string `bson:"kind"`
+	VideoID    string `bson:"video_id,omitempty"`
+	PlaylistID string `bson:"playlist_id,omitempty"`
+	// ChannelID is the channel found or else the channel of the video
+	// or playlist found, so that results can be looked up by channel.
+	ChannelID string `bson:"channel_id,omitempty"`
+	// IDChannelID and SnippetChannelID are the channel IDs
+	// of the result's ID and snippet, which ChannelID merges.
+	IDChannelID      string `bson:"id_channel_id,omitempty"`
+	SnippetChannelID string `bson:"snippet_channel_id,omitempty"`
+
+	// ResultKind is the kind of the result itself e.g. "youtube#searchResult".
+	ResultKind           string `bson:"result_kind,omitempty"`
+	Etag                 string `bson:"etag,omitempty"`
+	Title                string `bson:"title"`
+	Description          string `bson:"description,omitempty"`
+	ChannelTitle         string `bson:"channel_title,omitempty"`
+	PublishedAt          string `bson:"published_at,omitempty"`
+	LiveBroadcastContent string `bson:"live_broadcast_content,omitempty"`
+	// Thumbnails maps the thumbnail sizes e.g. "default" to the thumbnails.
+	Thumbnails map[string]*cachedThumbnail `bson:"thumbnail_details,omitempty"`
+}
+
+type cachedThumbnail struct {
+	URL    string `bson:"url"`
+	Width  int64  `bson:"width,omitempty"`
+	Height int64  `bson:"height,omitempty"`
+}
+
+type cachedPage struct {
+	Items []*cachedResult `bson:"items"`
+}
+
+// thumbnailSizes returns the thumbnails of th by their size.
+func thumbnailSizes(th *ytv3.ThumbnailDetails) map[string]*ytv3.Thumbnail {
+	return map[string]*ytv3.Thumbnail{
+		"default":  th.Default,
+		"medium":   th.Medium,
+		"high":     th.High,
+		"standard": th.Standard,
+		"maxres":   th.Maxres,
+	}
+}
+
+func newCachedResult(item *ytv3.SearchResult) *cachedResult {
+	cr := &cachedResult{ResultKind: item.Kind, Etag: item.Etag}
+	if id := item.Id; id != nil {
+		cr.Kind = id.Kind
+		cr.VideoID = id.VideoId
+		cr.PlaylistID = id.PlaylistId
+		cr.IDChannelID = id.ChannelId
+	}
+	cr.ChannelID = cr.IDChannelID
+	if sn := item.Snippet; sn != nil {
+		cr.Title = sn.Title
+		cr.Description = sn.Description
+		cr.ChannelTitle = sn.ChannelTitle
+		cr.PublishedAt = sn.PublishedAt
+		cr.LiveBroadcastContent = sn.LiveBroadcastContent
+		cr.SnippetChannelID = sn.ChannelId
+		if cr.ChannelID == "" {
+			cr.ChannelID = sn.ChannelId
+		}
+		if th := sn.Thumbnails; th != nil {
+			cr.Thumbnails = make(map[string]*cachedThumbnail)
+			for size, t := range thumbnailSizes(th) {
+				if t != nil {
+					cr.Thumbnails[size] = &cachedThumbnail{URL: t.Url, Width: t.Width, Height: t.Height}
+				}
+			}
+		}
+	}
+	return cr
+}
+
+// thumbnailURLs maps the sizes of cr's thumbnails to their URLs.
+func (cr *cachedResult) thumbnailURLs() map[string]string {
+	urls := make(map[string]string, len(cr.Thumbnails))
+	for size, t := range cr.Thumbnails {
+		if t != nil && t.URL != "" {
+			urls[size] = t.URL
+		}
+	}
+	return urls
+}
+
+// searchResult converts cr back into the form that providers return.
+func (cr *cachedResult) searchResult() *ytv3.SearchResult {
+	item := &ytv3.SearchResult{
+		Kind: cr.ResultKind,
+		Etag: cr.Etag,
+		Id: &ytv3.ResourceId{
+			Kind:       cr.Kind,
+			VideoId:    cr.VideoID,
+			ChannelId:  cr.IDChannelID,
+			PlaylistId: cr.PlaylistID,
+		},
+		Snippet: &ytv3.SearchResultSnippet{
+			Title:                cr.Title,
+			Description:          cr.Description,
+			ChannelId:            cr.SnippetChannelID,
+			ChannelTitle:         cr.ChannelTitle,
+			PublishedAt:          cr.PublishedAt,
+			LiveBroadcastContent: cr.LiveBroadcastContent,
+		},
+	}
+	if cr.Thumbnails != nil {
+		th := new(ytv3.ThumbnailDetails)
+		for size, ct := range cr.Thumbnails {
+			if ct == nil {
+				continue
+			}
+			t := &ytv3.Thumbnail{Url: ct.URL, Width: ct.Width, Height: ct.Height}
+			switch size {
+			case "default":
+				th.Default = t
+			case "medium":
+				th.Medium = t
+			case "high":
+				th.High = t
+			case "standard":
+				th.Standard = t
+			case "maxres":
+				th.Maxres = t
+			}
+		}
+		item.Snippet.Thumbnails = th
+	}
+	return item
+}
+
+// toCachedPages converts the marshaled pages of a dbCacheKV's Value.
+func toCachedPages(blob []byte) ([]*cachedPage, error) {
+	var pages []*youtube.SearchPage
+	if err := json.Unmarshal(blob, &pages); err != nil {
+		return nil, err
+	}
+	cachedPages := make([]*cachedPage, 0, len(pages))
+	for _, page := range pages {
+		cp := &cachedPage{Items: make([]*cachedResult, 0)}
+		if page != nil {
+			for _, item := range page.Items {
+				if item != nil {
+					cp.Items = append(cp.Items, newCachedResult(item))
+				}
+			}
+		}
+		cachedPages = append(cachedPages, cp)
+	}
+	return cachedPages, nil
+}
+
+// fromCachedPages is the inverse of toCachedPages.
+func fromCachedPages(cachedPages []*cachedPage) ([]byte, error) {
+	pages := make([]*youtube.SearchPage, 0, len(cachedPages))
+	for _, cp := range cachedPages {
+		page := new(youtube.SearchPage)
+		for _, cr := range cp.Items {
+			page.Items = append(page.Items, cr.searchResult())
+		}
+		pages = append(pages, page)
+	}
+	return json.Marshal(pages)
+}
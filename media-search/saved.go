@@ -0,0 +1,423 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+
+	"github.com/orijtech/youtube"
+)
+
+var (
+	// savedSearchesCollection holds the searches that users have saved.
+	savedSearchesCollection *mongo.Collection
+	// favoritesCollection holds the videos that users have favorited.
+	favoritesCollection *mongo.Collection
+)
+
+// maxSeenResults caps how many result IDs are remembered per
+// saved search to tell which results of a re-run are new.
+const maxSeenResults = 500
+
+type savedSearch struct {
+	ID     string `json:"id" bson:"_id"`
+	UserID string `json:"-" bson:"user"`
+	// Key is the cache key of the search, which
+	// stops users from saving the same one twice.
+	Key      string        `json:"-" bson:"key"`
+	Keywords string        `json:"q" bson:"q"`
+	Filters  searchFilters `json:"filters" bson:"filters"`
+	// MaxPerPage and MaxPages are the limits saved with the search,
+	// which every re-run of it applies.
+	MaxPerPage int64 `json:"max_per_page" bson:"max_per_page,omitempty"`
+	MaxPages   int64 `json:"max_pages" bson:"max_pages,omitempty"`
+
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	LastRun   time.Time `json:"last_run" bson:"last_run,omitempty"`
+	// NewResults are the IDs of the results that the last
+	// run found which none of the runs before it had.
+	NewResults []string `json:"new_results" bson:"new_results"`
+	Seen       []string `json:"-" bson:"seen"`
+}
+
+func (ss *savedSearch) query() *query {
+	q := &query{
+		Keywords:      ss.Keywords,
+		searchFilters: ss.Filters,
+		MaxPerPage:    ss.MaxPerPage,
+		MaxPages:      ss.MaxPages,
+	}
+	// Searches saved before their limits were kept get the defaults.
+	q.setDefaultLimits()
+	return q
+}
+
+type favorite struct {
+	UserID    string    `json:"-" bson:"user"`
+	VideoID   string    `json:"video_id" bson:"video_id"`
+	Title     string    `json:"title" bson:"title"`
+	Thumbnail string    `json:"thumbnail,omitempty" bson:"thumbnail,omitempty"`
+	AddedAt   time.Time `json:"added_at" bson:"added_at"`
+}
+
+func setupSaved(db *mongo.Database) {
+	savedSearchesCollection = db.Collection("saved_searches")
+	favoritesCollection = db.Collection("favorites")
+
+	indices := []struct {
+		coll  *mongo.Collection
+		model mongo.IndexModel
+	}{
+		{
+			savedSearchesCollection, mongo.IndexModel{
+				Keys: bson.NewDocument(bson.EC.Int32("user", 1), bson.EC.Int32("key", 1)),
+				Options: bson.NewDocument(
+					bson.EC.String("name", "user_key_unique"),
+					bson.EC.Boolean("unique", true),
+				),
+			},
+		}, {
+			favoritesCollection, mongo.IndexModel{
+				Keys: bson.NewDocument(bson.EC.Int32("user", 1), bson.EC.Int32("video_id", 1)),
+				Options: bson.NewDocument(
+					bson.EC.String("name", "user_video_unique"),
+					bson.EC.Boolean("unique", true),
+				),
+			},
+		},
+	}
+	for _, index := range indices {
+		if _, err := index.coll.Indexes().CreateOne(context.Background(), index.model); err != nil {
+			log.Printf("Failed to create a saved searches index: %v", err)
+		}
+	}
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// saved lists the requesting user's saved searches on GET,
+// saves a search, with the same parameters as /search, on
+// POST and deletes the one given by the "id" parameter on DELETE.
+func saved(w http.ResponseWriter, r *http.Request) {
+	ctx, span := trace.StartSpan(r.Context(), "/saved")
+	defer span.End()
+
+	ctx, _ = tag.New(ctx, tag.Upsert(endpointKey, "saved"))
+	// Saved searches and favorites are private, so they aren't
+	// shared between all the users that didn't identify themselves.
+	user, ok := identifiedUserID(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, errNoUserID)
+		return
+	}
+	span.AddAttributes(
+		trace.StringAttribute("user", user),
+		trace.StringAttribute("method", r.Method),
+	)
+
+	switch r.Method {
+	case "GET":
+		pipeline := bson.NewArray(
+			bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("$match", bson.EC.String("user", user))),
+			bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("$sort", bson.EC.Int32("created_at", -1))),
+		)
+		searches := make([]*savedSearch, 0)
+		if err := aggregate(ctx, savedSearchesCollection, pipeline, func(cur mongo.Cursor) error {
+			ss := new(savedSearch)
+			if err := cur.Decode(ss); err != nil {
+				return err
+			}
+			searches = append(searches, ss)
+			return nil
+		}); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, searches)
+
+	case "POST":
+		q, err := parseQuery(ctx, r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if q.Continuation != "" {
+			writeJSONError(w, http.StatusBadRequest, &validationError{Fields: []*fieldError{
+				{Field: "continuation", Message: "can't be saved"},
+			}})
+			return
+		}
+		ss := &savedSearch{
+			ID:         newID(),
+			UserID:     user,
+			Keywords:   q.Keywords,
+			Filters:    q.searchFilters,
+			MaxPerPage: q.MaxPerPage,
+			MaxPages:   q.MaxPages,
+			CreatedAt:  time.Now(),
+			NewResults: []string{},
+			Seen:       []string{},
+		}
+		ss.Key = ss.query().cacheKey()
+		if _, err := savedSearchesCollection.InsertOne(ctx, ss); err != nil {
+			if isDuplicateKeyError(err) {
+				writeJSONError(w, http.StatusConflict, errors.New("the search is saved already"))
+				return
+			}
+			stats.Record(ctx, mongoErrors.M(1))
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSONStatus(w, http.StatusCreated, ss)
+
+	case "DELETE":
+		deleteOwned(ctx, w, savedSearchesCollection, bson.NewDocument(
+			bson.EC.String("_id", r.URL.Query().Get("id")),
+			bson.EC.String("user", user),
+		))
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("only GET, POST and DELETE are supported"))
+	}
+}
+
+// favorites lists the requesting user's favorite videos on GET,
+// adds the video in the JSON body on POST and removes the one
+// given by the "video_id" parameter on DELETE.
+func favorites(w http.ResponseWriter, r *http.Request) {
+	ctx, span := trace.StartSpan(r.Context(), "/favorites")
+	defer span.End()
+
+	ctx, _ = tag.New(ctx, tag.Upsert(endpointKey, "favorites"))
+	// Saved searches and favorites are private, so they aren't
+	// shared between all the users that didn't identify themselves.
+	user, ok := identifiedUserID(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, errNoUserID)
+		return
+	}
+	span.AddAttributes(
+		trace.StringAttribute("user", user),
+		trace.StringAttribute("method", r.Method),
+	)
+
+	switch r.Method {
+	case "GET":
+		pipeline := bson.NewArray(
+			bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("$match", bson.EC.String("user", user))),
+			bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("$sort", bson.EC.Int32("added_at", -1))),
+		)
+		favs := make([]*favorite, 0)
+		if err := aggregate(ctx, favoritesCollection, pipeline, func(cur mongo.Cursor) error {
+			fav := new(favorite)
+			if err := cur.Decode(fav); err != nil {
+				return err
+			}
+			favs = append(favs, fav)
+			return nil
+		}); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, favs)
+
+	case "POST":
+		fav := new(favorite)
+		if err := json.NewDecoder(r.Body).Decode(fav); err != nil {
+			writeJSONError(w, http.StatusBadRequest, &validationError{Fields: []*fieldError{
+				{Field: "body", Message: "must be a JSON object: " + err.Error()},
+			}})
+			return
+		}
+		fav.VideoID = strings.TrimSpace(fav.VideoID)
+		if fav.VideoID == "" {
+			errs := []*fieldError{{Field: "video_id", Message: "is required"}}
+			recordValidationFailures(ctx, errs)
+			writeJSONError(w, http.StatusBadRequest, &validationError{Fields: errs})
+			return
+		}
+		fav.UserID = user
+		fav.AddedAt = time.Now()
+		// Favoriting a video twice is harmless so duplicates are ignored.
+		if _, err := favoritesCollection.InsertOne(ctx, fav); err != nil && !isDuplicateKeyError(err) {
+			stats.Record(ctx, mongoErrors.M(1))
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSONStatus(w, http.StatusCreated, fav)
+
+	case "DELETE":
+		deleteOwned(ctx, w, favoritesCollection, bson.NewDocument(
+			bson.EC.String("video_id", r.URL.Query().Get("video_id")),
+			bson.EC.String("user", user),
+		))
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("only GET, POST and DELETE are supported"))
+	}
+}
+
+// deleteOwned deletes the document matching filter, which must
+// include the user so that users can only delete their own.
+func deleteOwned(ctx context.Context, w http.ResponseWriter, coll *mongo.Collection, filter *bson.Document) {
+	res, err := coll.DeleteOne(ctx, filter)
+	switch {
+	case err != nil:
+		stats.Record(ctx, mongoErrors.M(1))
+		writeJSONError(w, http.StatusInternalServerError, err)
+	case res.DeletedCount == 0:
+		writeJSONError(w, http.StatusNotFound, errors.New("not found"))
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// rerunSavedSearches re-runs every saved search each interval.
+func rerunSavedSearches(interval time.Duration) {
+	for range time.Tick(interval) {
+		rerunSavedSearchesOnce()
+	}
+}
+
+// rerunSavedSearchesOnce re-runs every saved search and records which
+// of its results are new. Each run is the root span of its own trace
+// since it isn't part of any request.
+func rerunSavedSearchesOnce() {
+	ctx, span := trace.StartSpan(context.Background(), "/rerun-saved-searches")
+	defer span.End()
+
+	var searches []*savedSearch
+	pipeline := bson.NewArray(
+		bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("$sort", bson.EC.Int32("created_at", 1))),
+	)
+	if err := aggregate(ctx, savedSearchesCollection, pipeline, func(cur mongo.Cursor) error {
+		ss := new(savedSearch)
+		if err := cur.Decode(ss); err != nil {
+			return err
+		}
+		searches = append(searches, ss)
+		return nil
+	}); err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+		return
+	}
+	span.AddAttributes(trace.Int64Attribute("saved_searches", int64(len(searches))))
+
+	for _, ss := range searches {
+		if quota != nil && quota.nearlyExhausted() {
+			span.Annotate(nil, "Stopping since the YouTube API quota is nearly exhausted")
+			return
+		}
+		if err := rerunSavedSearch(ctx, ss); err != nil {
+			span.Annotate([]trace.Attribute{
+				trace.StringAttribute("id", ss.ID),
+				trace.StringAttribute("error", err.Error()),
+			}, "Failed to re-run a saved search")
+		}
+	}
+}
+
+func rerunSavedSearch(ctx context.Context, ss *savedSearch) error {
+	ctx, span := trace.StartSpan(ctx, "/rerun-saved-search")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("id", ss.ID))
+
+	// The results should be fresh, rather than cached, but
+	// concurrent searches for the same query are coalesced.
+	q := ss.query()
+	cacheKey := q.cacheKey()
+	kv, err, _ := searchGroup.Do(ctx, cacheKey, func(ctx context.Context) (*dbCacheKV, error) {
+		return fetchAndCache(ctx, q, cacheKey, nil)
+	})
+	if err != nil {
+		return err
+	}
+	var pages []*youtube.SearchPage
+	if err := json.Unmarshal(kv.Value, &pages); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(ss.Seen))
+	for _, id := range ss.Seen {
+		seen[id] = true
+	}
+	newResults := make([]string, 0)
+	for _, page := range pages {
+		for _, item := range page.Items {
+			if item == nil || item.Id == nil {
+				continue
+			}
+			id := item.Id.VideoId + item.Id.ChannelId + item.Id.PlaylistId
+			if id == "" || seen[id] {
+				continue
+			}
+			seen[id] = true
+			newResults = append(newResults, id)
+		}
+	}
+	allSeen := append(ss.Seen, newResults...)
+	if len(allSeen) > maxSeenResults {
+		allSeen = allSeen[len(allSeen)-maxSeenResults:]
+	}
+	// The first run only establishes what has been seen, so
+	// it records every result as seen but reports none as new.
+	if ss.LastRun.IsZero() {
+		newResults = []string{}
+	}
+	span.AddAttributes(trace.Int64Attribute("new_results", int64(len(newResults))))
+	stats.Record(ctx, savedSearchNewResults.M(int64(len(newResults))))
+
+	_, err = savedSearchesCollection.UpdateOne(ctx,
+		bson.NewDocument(bson.EC.String("_id", ss.ID)),
+		bson.NewDocument(bson.EC.SubDocumentFromElements("$set",
+			bson.EC.Time("last_run", time.Now()),
+			bson.EC.Array("new_results", stringArray(newResults)),
+			bson.EC.Array("seen", stringArray(allSeen)),
+		)),
+	)
+	if err != nil {
+		stats.Record(ctx, mongoErrors.M(1))
+	}
+	return err
+}
+
+func stringArray(strs []string) *bson.Array {
+	values := make([]*bson.Value, 0, len(strs))
+	for _, str := range strs {
+		values = append(values, bson.VC.String(str))
+	}
+	return bson.NewArray(values...)
+}
+
+var savedSearchNewResults = stats.Int64("saved_search_new_results", "the number of new results found by re-running saved searches", stats.UnitNone)
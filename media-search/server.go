@@ -15,21 +15,17 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"reflect"
+	"strconv"
 	"time"
 
-	gat "google.golang.org/api/googleapi/transport"
-
-	"github.com/mongodb/mongo-go-driver/bson"
 	"github.com/mongodb/mongo-go-driver/mongo"
 
 	xray "github.com/census-instrumentation/opencensus-go-exporter-aws"
@@ -46,29 +42,136 @@ import (
 	"github.com/orijtech/youtube"
 )
 
-var yc *youtube.Client
+var provider SearchProvider
+var resultCache ResultCache
+var signer *tokenSigner
 var ytSearchesCollection *mongo.Collection
 
+// grpcAddr is the address on which the MediaSearch gRPC service is served.
+var grpcAddr string
+
+// savedRerunInterval is how often saved searches are re-run, or 0 for never.
+var savedRerunInterval time.Duration
+
+var providerKey, cacheBackendKey, endpointKey tag.Key
+
+var (
+	// cacheTTL is how long a cached result is fresh for.
+	cacheTTL time.Duration
+	// cacheStaleTTL is how long past cacheTTL a cached result may
+	// still be served while it is refreshed in the background.
+	cacheStaleTTL time.Duration
+	// cacheRetainTTL is how long past the stale window a cached result
+	// is kept, to be served only while the circuit breaker is open.
+	cacheRetainTTL time.Duration
+)
+
+// config holds the settings taken from flags and the environment.
+type config struct {
+	providerName string
+	fixturesDir  string
+	cache        cacheConfig
+	tokenSecret  string
+
+	quotaBudget  int64
+	quotaReserve int64
+
+	breakerFailures    int
+	breakerOpenTimeout time.Duration
+	breakerProbes      int
+	providerTimeout    time.Duration
+
+	thumbCacheDir   string
+	thumbCacheBytes int64
+
+	suggestionsRefreshInterval time.Duration
+}
+
+var cfg = new(config)
+
 func init() {
+	flag.StringVar(&cfg.providerName, "provider", otils.EnvOrAlternates("MEDIA_SEARCH_PROVIDER", providerYouTube),
+		"the search provider to use, either \"youtube\" or \"fixture\"")
+	flag.StringVar(&cfg.fixturesDir, "fixtures-dir", otils.EnvOrAlternates("MEDIA_SEARCH_FIXTURES_DIR", "./fixtures"),
+		"the directory of JSON result pages served by the fixture provider")
+	flag.DurationVar(&cacheTTL, "cache-ttl", envDuration("MEDIA_SEARCH_CACHE_TTL", time.Hour),
+		"how long cached search results are fresh for")
+	flag.DurationVar(&cacheStaleTTL, "cache-stale-ttl", envDuration("MEDIA_SEARCH_CACHE_STALE_TTL", 24*time.Hour),
+		"how long past the cache TTL a stale result may be served while it is refreshed")
+	flag.DurationVar(&cacheRetainTTL, "cache-retain-ttl", envDuration("MEDIA_SEARCH_CACHE_RETAIN_TTL", 7*24*time.Hour),
+		"how long past the stale window an expired result is kept to be served while the circuit breaker is open")
+	flag.StringVar(&cfg.cache.backend, "cache", otils.EnvOrAlternates("MEDIA_SEARCH_CACHE", cacheBackendMongo),
+		"the cache backend to use, one of \"mongo\", \"lru\", \"badger\" or \"redis\"")
+	flag.IntVar(&cfg.cache.lruSize, "lru-size", 1000, "the maximum number of entries held by the lru cache")
+	flag.StringVar(&cfg.cache.badgerDir, "badger-dir", otils.EnvOrAlternates("MEDIA_SEARCH_BADGER_DIR", "./badger-data"),
+		"the directory in which the badger cache stores its data")
+	flag.StringVar(&cfg.cache.redisAddr, "redis-addr", otils.EnvOrAlternates("MEDIA_SEARCH_REDIS_ADDR", "localhost:6379"),
+		"the address of the Redis server used by the redis cache")
+	flag.StringVar(&cfg.tokenSecret, "token-secret", os.Getenv("MEDIA_SEARCH_TOKEN_SECRET"),
+		"the secret with which continuation tokens are signed, random if unset")
+	flag.Int64Var(&cfg.quotaBudget, "quota-budget", envInt64("MEDIA_SEARCH_QUOTA_BUDGET", 10000),
+		"the daily YouTube API quota budget in units, or 0 for no budget")
+	flag.Int64Var(&cfg.quotaReserve, "quota-reserve", envInt64("MEDIA_SEARCH_QUOTA_RESERVE", 500),
+		"the units of quota below which only cached results are served")
+	flag.IntVar(&cfg.breakerFailures, "breaker-failures", 5,
+		"the number of consecutive provider failures that open the circuit breaker")
+	flag.DurationVar(&cfg.breakerOpenTimeout, "breaker-open-timeout", envDuration("MEDIA_SEARCH_BREAKER_OPEN_TIMEOUT", 30*time.Second),
+		"how long the circuit breaker stays open before letting probes through")
+	flag.IntVar(&cfg.breakerProbes, "breaker-half-open-probes", 1,
+		"the number of successful probes that close a half-open circuit breaker")
+	flag.DurationVar(&cfg.providerTimeout, "provider-timeout", envDuration("MEDIA_SEARCH_PROVIDER_TIMEOUT", 10*time.Second),
+		"how long a provider call may take before it counts as a failure")
+	flag.Int64Var(&maxPagesLimit, "max-pages-limit", envInt64("MEDIA_SEARCH_MAX_PAGES_LIMIT", 10),
+		"the most pages that a single search may ask for")
+	flag.StringVar(&grpcAddr, "grpc-addr", otils.EnvOrAlternates("MEDIA_SEARCH_GRPC_ADDR", ":9779"),
+		"the address on which to serve the MediaSearch gRPC service")
+	flag.DurationVar(&savedRerunInterval, "saved-rerun-interval", envDuration("MEDIA_SEARCH_SAVED_RERUN_INTERVAL", time.Hour),
+		"how often saved searches are re-run to find new results, or 0 to never re-run them")
+	flag.StringVar(&cfg.thumbCacheDir, "thumb-cache-dir", otils.EnvOrAlternates("MEDIA_SEARCH_THUMB_CACHE_DIR", "./thumb-cache"),
+		"the directory in which proxied thumbnails are cached")
+	flag.Int64Var(&cfg.thumbCacheBytes, "thumb-cache-bytes", envInt64("MEDIA_SEARCH_THUMB_CACHE_BYTES", 100<<20),
+		"the most bytes of thumbnails to cache on disk")
+	flag.BoolVar(&removeStopWords, "remove-stop-words", os.Getenv("MEDIA_SEARCH_REMOVE_STOP_WORDS") != "",
+		"whether to drop stop words such as \"the\" from queries when normalizing them")
+	flag.DurationVar(&cfg.suggestionsRefreshInterval, "suggestions-refresh-interval", envDuration("MEDIA_SEARCH_SUGGESTIONS_REFRESH_INTERVAL", 10*time.Minute),
+		"how often the did you mean suggestions are reloaded from the search history")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("MEDIA_SEARCH_ADMIN_TOKEN"),
+		"the bearer token that authorizes /admin requests, which are refused if it is unset")
+}
+
+// dependencies are the external services that the server relies on.
+// The server is set up with them injected, so that they can be
+// replaced, as the tests replace them with in-process fakes.
+type dependencies struct {
+	traceExporters []trace.Exporter
+	viewExporters  []view.Exporter
+
+	// provider is wrapped by the quota accountant and circuit breaker.
+	provider SearchProvider
+	cache    ResultCache
+	thumbs   *thumbCache
+
+	// mongoDB may be nil, in which case searches aren't recorded and
+	// the history, saved searches, favorites and videos are unavailable.
+	mongoDB *mongo.Database
+}
+
+// productionDependencies connects to the real exporters, search
+// provider, MongoDB and cache backend that cfg configures.
+func productionDependencies(cfg *config) (*dependencies, error) {
 	xe, err := xray.NewExporter(xray.WithVersion("latest"))
 	if err != nil {
-		log.Fatalf("X-Ray newExporter: %v", err)
+		return nil, fmt.Errorf("X-Ray newExporter: %v", err)
 	}
 	se, err := stackdriver.NewExporter(stackdriver.Options{ProjectID: otils.EnvOrAlternates("OPENCENSUS_GCP_PROJECTID", "census-demos")})
 	if err != nil {
-		log.Fatalf("Stackdriver newExporter: %v", err)
+		return nil, fmt.Errorf("Stackdriver newExporter: %v", err)
 	}
 	pe, err := prometheus.NewExporter(prometheus.Options{Namespace: "mediasearch"})
 	if err != nil {
-		log.Fatalf("Prometheus newExporter: %v", err)
+		return nil, fmt.Errorf("Prometheus newExporter: %v", err)
 	}
 
-	// Now register the exporters
-	trace.RegisterExporter(xe)
-	trace.RegisterExporter(se)
-	view.RegisterExporter(se)
-	view.RegisterExporter(pe)
-
 	// Serve the Prometheus metrics
 	go func() {
 		mux := http.NewServeMux()
@@ -76,6 +179,51 @@ func init() {
 		log.Fatal(http.ListenAndServe(":9888", mux))
 	}()
 
+	provider, err := newSearchProvider(cfg.providerName, cfg.fixturesDir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the %q search provider: %v", cfg.providerName, err)
+	}
+
+	// Log into MongoDB
+	mongoServerURI := otils.EnvOrAlternates("MEDIA_SEARCH_MONGO_SERVER_URI", "localhost:27017")
+	log.Printf("mongoServerURI: %q\n", mongoServerURI)
+	mongoClient, err := mongo.NewClient("mongodb://" + mongoServerURI)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to log into Mongo error: %v", err)
+	}
+	// Create or get the searches collection.
+	mongoDB := mongoClient.Database("media-searches")
+	ytSearchesCollection = mongoDB.Collection("youtube_searches")
+
+	cache, err := newResultCache(&cfg.cache)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the %q cache: %v", cfg.cache.backend, err)
+	}
+	thumbs, err := newThumbCache(cfg.thumbCacheDir, cfg.thumbCacheBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the thumbnail cache: %v", err)
+	}
+
+	return &dependencies{
+		traceExporters: []trace.Exporter{xe, se},
+		viewExporters:  []view.Exporter{se, pe},
+		provider:       provider,
+		cache:          cache,
+		thumbs:         thumbs,
+		mongoDB:        mongoDB,
+	}, nil
+}
+
+// setup readies the server to serve with deps, as cfg configures.
+func setup(cfg *config, deps *dependencies) {
+	// Now register the exporters
+	for _, e := range deps.traceExporters {
+		trace.RegisterExporter(e)
+	}
+	for _, e := range deps.viewExporters {
+		view.RegisterExporter(e)
+	}
+
 	// And then set the trace config with the default sampler.
 	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
 	view.SetReportingPeriod(250 * time.Millisecond)
@@ -91,23 +239,102 @@ func init() {
 		}
 		return k
 	}
+	providerKey = mustKey("provider")
+	cacheBackendKey = mustKey("cache_backend")
+	endpointKey = mustKey("endpoint")
+	breakerStateKey = mustKey("breaker_state")
+	fieldKey = mustKey("field")
+	encodingKey = mustKey("content_encoding")
+	thumbCacheKey = mustKey("thumb_cache")
+	sourceKey = mustKey("source")
 
 	// And then for the custom views
-	err = view.Register([]*view.View{
-		{Name: "cache_hits", Description: "cache hits", Measure: cacheHits, Aggregation: view.Count()},
-		{Name: "cache_misses", Description: "cache misses", Measure: cacheMisses, Aggregation: view.Count()},
+	err := view.Register([]*view.View{
+		{
+			Name: "cache_hits", Description: "cache hits",
+			Measure: cacheHits, Aggregation: view.Count(), TagKeys: []tag.Key{cacheBackendKey},
+		}, {
+			Name: "cache_misses", Description: "cache misses",
+			Measure: cacheMisses, Aggregation: view.Count(), TagKeys: []tag.Key{cacheBackendKey},
+		}, {
+			Name: "cache_stale_served", Description: "stale cache results served",
+			Measure: cacheStaleServed, Aggregation: view.Count(), TagKeys: []tag.Key{cacheBackendKey},
+		}, {
+			Name: "cache_age", Description: "the age of cached results when they are read",
+			Measure: cacheAge, TagKeys: []tag.Key{cacheBackendKey}, Aggregation: view.Distribution(
+				// [0s, 1m, 5m, 15m, 30m, 1h, 2h, 6h, 12h, 1d, 2d, 1w]
+				0, 60, 300, 900, 1800, 3600, 7200, 21600, 43200, 86400, 172800, 604800,
+			),
+		},
 		{
 			Name: "cache_insertion_errors", Description: "cache insertion errors",
-			Measure: cacheInsertionErrors, Aggregation: view.Count(), TagKeys: []tag.Key{mustKey("cache_errors")},
+			Measure: cacheInsertionErrors, Aggregation: view.Count(), TagKeys: []tag.Key{mustKey("cache_errors"), cacheBackendKey},
+		}, {
+			Name: "cache_lookup_errors", Description: "cache lookup errors, after which searches go on as misses",
+			Measure: cacheLookupErrors, Aggregation: view.Count(), TagKeys: []tag.Key{cacheBackendKey},
+		}, {
+			Name: "coalesced_requests", Description: "requests that waited on an in-flight upstream call",
+			Measure: coalescedRequests, Aggregation: view.Count(),
 		}, {
 
 			Name: "youtube_api_errors", Description: "youtube errors",
 			Measure: youtubeAPIErrors, Aggregation: view.Count(),
-			TagKeys: []tag.Key{mustKey("api"), mustKey("youtube_api")},
+			TagKeys: []tag.Key{mustKey("api"), mustKey("youtube_api"), providerKey},
+		}, {
+			Name: "history_requests", Description: "search history and trending requests",
+			Measure: historyRequests, Aggregation: view.Count(), TagKeys: []tag.Key{endpointKey},
+		}, {
+			Name: "history_insertion_errors", Description: "errors recording searches in the history",
+			Measure: historyInsertionErrors, Aggregation: view.Count(),
 		}, {
 			Name: "mongo_errors", Description: "MongoDB errors",
 			Measure: mongoErrors, Aggregation: view.Count(),
 			TagKeys: []tag.Key{mustKey("api"), mustKey("mongo")},
+		}, {
+			Name: "breaker_transitions", Description: "search provider circuit breaker state changes",
+			Measure: breakerTransitions, Aggregation: view.Count(), TagKeys: []tag.Key{breakerStateKey},
+		}, {
+			Name: "validation_failures", Description: "invalid request fields",
+			Measure: validationFailures, Aggregation: view.Count(), TagKeys: []tag.Key{fieldKey},
+		}, {
+			Name: "youtube_quota_remaining", Description: "the units left of the daily YouTube API quota",
+			Measure: youtubeQuotaRemaining, Aggregation: view.LastValue(),
+		}, {
+			Name: "quota_rejections", Description: "searches refused for lack of YouTube API quota",
+			Measure: quotaRejections, Aggregation: view.Count(),
+		}, {
+			Name: "response_bytes", Description: "the size of response bodies before compression",
+			Measure: responseBytes, TagKeys: []tag.Key{encodingKey}, Aggregation: responseSizeDistribution,
+		}, {
+			Name: "response_encoded_bytes", Description: "the size of response bodies as sent, after any compression",
+			Measure: responseEncodedBytes, TagKeys: []tag.Key{encodingKey}, Aggregation: responseSizeDistribution,
+		}, {
+			Name: "thumb_requests", Description: "thumbnails served, tagged by whether they were cached",
+			Measure: thumbRequests, Aggregation: view.Count(), TagKeys: []tag.Key{thumbCacheKey},
+		}, {
+			Name: "thumb_bytes_served", Description: "the bytes of thumbnails served",
+			Measure: thumbBytesServed, Aggregation: view.Sum(), TagKeys: []tag.Key{thumbCacheKey},
+		}, {
+			Name: "search_latency", Description: "the end to end latency of searches",
+			Measure: searchLatency, TagKeys: []tag.Key{sourceKey}, Aggregation: latencyDistribution,
+		}, {
+			Name: "cache_lookup_latency", Description: "the latency of cache lookups",
+			Measure: cacheLookupLatency, TagKeys: []tag.Key{cacheBackendKey}, Aggregation: latencyDistribution,
+		}, {
+			Name: "upstream_fetch_latency", Description: "the latency of fetching results from the search provider",
+			Measure: upstreamFetchLatency, TagKeys: []tag.Key{providerKey}, Aggregation: latencyDistribution,
+		}, {
+			Name: "search_payload_bytes", Description: "the size of the marshaled results of searches",
+			Measure: searchPayloadBytes, TagKeys: []tag.Key{sourceKey}, Aggregation: responseSizeDistribution,
+		}, {
+			Name: "search_result_items", Description: "the number of results that searches return",
+			Measure: searchResultItems, TagKeys: []tag.Key{sourceKey}, Aggregation: itemsDistribution,
+		}, {
+			Name: "suggestions_offered", Description: "the number of did you mean suggestions offered for queries that found nothing",
+			Measure: suggestionsOffered, Aggregation: view.Distribution(0, 1, 2, 3),
+		}, {
+			Name: "saved_search_new_results", Description: "new results found by re-running saved searches",
+			Measure: savedSearchNewResults, Aggregation: view.Sum(),
 		},
 	}...)
 	if err != nil {
@@ -116,41 +343,127 @@ func init() {
 
 	log.Printf("Successfully finished exporter and view registration")
 
-	envAPIKey := os.Getenv("YOUTUBE_API_KEY")
-	yc, err = youtube.NewWithHTTPClient(&http.Client{
-		Transport: &ochttp.Transport{Base: &gat.APIKey{Key: envAPIKey}},
-	})
+	provider = deps.provider
+	log.Printf("Using the %q search provider", provider.Name())
+	if provider.Name() == providerYouTube && cfg.quotaBudget > 0 {
+		quota = newQuotaAccountant(cfg.quotaBudget, cfg.quotaReserve)
+		provider = &quotaProvider{SearchProvider: provider, qa: quota}
+	}
+	// The breaker is outermost so that no quota is spent while it's open.
+	breaker = newCircuitBreaker(cfg.breakerFailures, cfg.breakerOpenTimeout, cfg.breakerProbes)
+	provider = &breakerProvider{SearchProvider: provider, cb: breaker, callTimeout: cfg.providerTimeout}
+
+	signer, err = newTokenSigner(cfg.tokenSecret)
 	if err != nil {
-		log.Fatalf("Failed to create youtube API client: %v", err)
+		log.Fatalf("Failed to create the continuation token signer: %v", err)
+	}
+	if cfg.tokenSecret == "" {
+		log.Printf("No token secret was set, so continuation tokens won't survive restarts")
 	}
 
-	// Log into MongoDB
-	mongoServerURI := otils.EnvOrAlternates("MEDIA_SEARCH_MONGO_SERVER_URI", "localhost:27017")
-	mongoClient, err := mongo.NewClient("mongodb://" + mongoServerURI)
-log.Printf("mongoServerURI: %q\n", mongoServerURI)
+	if deps.mongoDB != nil {
+		setupHistory(deps.mongoDB)
+		setupSaved(deps.mongoDB)
+		setupAdmin(deps.mongoDB)
+		setupVideos(deps.mongoDB)
+		go querySuggester.refreshEvery(cfg.suggestionsRefreshInterval)
+	}
+
+	resultCache = deps.cache
+	log.Printf("Using the %q cache backend", resultCache.Name())
+	thumbs = deps.thumbs
+}
+
+func envDuration(envKey string, alt time.Duration) time.Duration {
+	str := os.Getenv(envKey)
+	if str == "" {
+		return alt
+	}
+	d, err := time.ParseDuration(str)
 	if err != nil {
-		log.Fatalf("Failed to log into Mongo error: %v", err)
+		log.Fatalf("Parsing %s=%q as a duration: %v", envKey, str, err)
 	}
-	// Create or get the searches collection.
-	ytSearchesCollection = mongoClient.Database("media-searches").Collection("youtube_searches")
+	return d
+}
+
+func envInt64(envKey string, alt int64) int64 {
+	str := os.Getenv(envKey)
+	if str == "" {
+		return alt
+	}
+	i, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		log.Fatalf("Parsing %s=%q as an integer: %v", envKey, str, err)
+	}
+	return i
 }
 
 func main() {
+	// Flags are parsed here rather than in init, so that
+	// go test can define and parse its own flags first.
+	flag.Parse()
+
+	deps, err := productionDependencies(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setup(cfg, deps)
+
+	go func() {
+		if err := serveGRPC(grpcAddr); err != nil {
+			log.Fatalf("Serving gRPC err: %v", err)
+		}
+	}()
+
+	if savedRerunInterval > 0 {
+		go rerunSavedSearches(savedRerunInterval)
+	}
+
 	addr := ":9778"
+	log.Printf("Serving on %q", addr)
+	if err := http.ListenAndServe(addr, newHandler()); err != nil {
+		log.Fatalf("ListenAndServe err: %v", err)
+	}
+}
+
+// newHandler returns the handler that serves all the HTTP routes.
+func newHandler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/search", search)
+	mux.HandleFunc("/history", withMongo(searchHistoryCollection, history))
+	mux.HandleFunc("/trending", withMongo(queryStatsCollection, trending))
+	mux.HandleFunc("/saved", withMongo(savedSearchesCollection, saved))
+	mux.HandleFunc("/favorites", withMongo(favoritesCollection, favorites))
+	mux.Handle("/admin/", adminHandler())
+	mux.HandleFunc("/videos/", withMongo(videosCollection, videoByID))
+	if thumbs != nil {
+		mux.HandleFunc("/thumb/", thumb)
+	} else {
+		mux.HandleFunc("/thumb/", unavailable("the thumbnail cache"))
+	}
 	mux.Handle("/", http.FileServer(http.Dir("./static")))
 
-	h := &ochttp.Handler{
-		Handler:     mux,
+	return &ochttp.Handler{
+		Handler:     compressHandler(mux),
 		Propagation: &b3.HTTPFormat{},
 	}
-	if err := view.Register(ochttp.DefaultServerViews...); err != nil {
-		log.Fatalf("Error register all the default Server views: %v", err)
+}
+
+// withMongo returns fn if the server was set up with the MongoDB
+// collection that fn reads and writes, which is nil otherwise.
+func withMongo(coll *mongo.Collection, fn http.HandlerFunc) http.HandlerFunc {
+	if coll == nil {
+		return unavailable("MongoDB")
 	}
-	log.Printf("Serving on %q", addr)
-	if err := http.ListenAndServe(addr, h); err != nil {
-		log.Fatalf("ListenAndServe err: %v", err)
+	return fn
+}
+
+// unavailable responds with 503 Service Unavailable to the requests
+// of routes whose dependency the server was set up without.
+func unavailable(dependency string) http.HandlerFunc {
+	err := fmt.Errorf("this server is running without %s", dependency)
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusServiceUnavailable, err)
 	}
 }
 
@@ -158,51 +471,49 @@ type query struct {
 	Keywords   string `json:"q"`
 	MaxPerPage int64  `json:"max_per_page"`
 	MaxPages   int64  `json:"max_pages"`
+	searchFilters
+
+	// Continuation is a token from a previous response
+	// which requests the page after that response's.
+	Continuation string `json:"continuation,omitempty"`
+
+	// pageToken is the upstream token of the first page to retrieve.
+	pageToken string
 }
 
 type dbCacheKV struct {
 	Key       string    `json:"key" bson:"key,omitempty"`
 	Value     []byte    `json:"value" bson:"value,omitempty"`
 	CacheTime time.Time `json:"ct" bson:"ct,omitempty"`
+	Expires   time.Time `json:"exp" bson:"exp,omitempty"`
+	// NextPageToken is the upstream token of the page after the
+	// last one in Value, or "" if there are no more pages.
+	NextPageToken string `json:"npt,omitempty" bson:"npt,omitempty"`
+
+	// stale is set on entries served past cacheTTL.
+	stale bool
+	// fromUpstream is set on entries that were just fetched.
+	fromUpstream bool
 }
 
+// parseQuery binds the search query of req and validates it,
+// recording every invalid field and returning a *validationError.
 func parseQuery(ctx context.Context, req *http.Request) (*query, error) {
 	ctx, span := trace.StartSpan(ctx, "parseQuery")
 	defer span.End()
 
-	var body io.Reader
-	switch req.Method {
-	default:
-		return nil, fmt.Errorf("Unsupported method: %q", req.Method)
-
-	case "POST", "PUT":
-		body = req.Body
-		span.Annotate([]trace.Attribute{
-			trace.StringAttribute("method", req.Method),
-			trace.BoolAttribute("has_body", true),
-		}, "Parsed a POST/PUT request")
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute("method", req.Method),
+		trace.StringAttribute("content_type", req.Header.Get("Content-Type")),
+	}, "Binding the query")
 
-	case "GET":
-		span.Annotate([]trace.Attribute{
-			trace.StringAttribute("method", "GET"),
-			trace.BoolAttribute("has_body", false),
-		}, "Parsed a GET request")
-
-		qv := req.URL.Query()
-		outMap := make(map[string]string)
-		for key := range qv {
-			outMap[key] = qv.Get(key)
-		}
-		intermediateBlob, err := json.Marshal(outMap)
-		if err != nil {
-			return nil, err
-		}
-		body = bytes.NewReader(intermediateBlob)
+	q, errs := bindQuery(ctx, req)
+	if q != nil {
+		errs = append(errs, q.validate()...)
 	}
-
-	q := new(query)
-	if err := parseJSON(ctx, body, q); err != nil {
-		return nil, err
+	if len(errs) > 0 {
+		recordValidationFailures(ctx, errs)
+		return nil, &validationError{Fields: errs}
 	}
 	return q, nil
 }
@@ -210,122 +521,393 @@ func parseQuery(ctx context.Context, req *http.Request) (*query, error) {
 func search(w http.ResponseWriter, r *http.Request) {
 	sc := trace.FromContext(r.Context()).SpanContext()
 	log.Printf("search here: %+v\n", sc)
+	start := time.Now()
 	ctx, span := trace.StartSpan(r.Context(), "/search")
 	defer span.End()
 
 	q, err := parseQuery(ctx, r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, err)
 		return
 	}
 	q.setDefaultLimits()
 
-	keywords := q.Keywords
-	filter := bson.NewDocument(bson.EC.String("key", q.Keywords))
+	if q.Continuation != "" {
+		if q, err = q.resolveContinuation(); err != nil {
+			errs := []*fieldError{{Field: "continuation", Message: "is invalid"}}
+			recordValidationFailures(ctx, errs)
+			writeJSONError(w, http.StatusBadRequest, &validationError{Fields: errs})
+			return
+		}
+		span.Annotate([]trace.Attribute{
+			trace.StringAttribute("page_token", q.pageToken),
+		}, "Continuing from a previous response")
+	}
+
+	// Only searches that get results are recorded in the history.
+	succeeded := false
+	var items int64
+	defer func() {
+		if succeeded {
+			recordSearch(ctx, userID(r), q.Keywords, items)
+		}
+	}()
+
+	ps := newPageStreamer(w, r)
+	writeResults := func(kv *dbCacheKV, suggestions []string) {
+		if kv.stale {
+			w.Header().Set("Warning", `110 - "Response is Stale"`)
+		}
+		token := q.continuationToken(kv.NextPageToken)
+		if ps == nil {
+			if token != "" {
+				w.Header().Set("X-Continuation-Token", token)
+			}
+			if len(suggestions) > 0 {
+				w.Header().Set("X-Suggestions", suggestionsHeader(suggestions))
+			}
+			etag := resultETag(kv)
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", resultCacheControl(kv))
+			w.Header().Add("Vary", "Accept")
+			if (r.Method == "GET" || r.Method == "HEAD") && etagMatches(r.Header.Get("If-None-Match"), etag) {
+				span.Annotate([]trace.Attribute{trace.StringAttribute("etag", etag)}, "Not modified")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			body := kv.Value
+			if r.URL.Query().Get("envelope") == "1" {
+				body, _ = json.Marshal(&resultsEnvelope{
+					Results:      json.RawMessage(kv.Value),
+					Continuation: token,
+					Suggestions:  suggestions,
+				})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(body)
+			return
+		}
+		if err := ps.writeAll(kv.Value); err != nil {
+			_ = ps.writeError(err)
+		}
+		_ = ps.finish(token, suggestions)
+	}
+	// When streaming, each page is written as soon as it arrives.
+	var onPage func(*youtube.SearchPage)
+	if ps != nil {
+		span.AddAttributes(trace.StringAttribute("stream", ps.format))
+		onPage = func(page *youtube.SearchPage) { _ = ps.writePage(page) }
+	}
+
+	kv, streamed, err := lookupOrFetch(ctx, q, onPage)
+	switch {
+	case err != nil && ps != nil && ps.started:
+		// Too late for a status code so report it in the stream.
+		_ = ps.writeError(err)
+	case err == errQuotaExhausted:
+		w.Header().Set("Retry-After", strconv.Itoa(int(quota.retryAfter()/time.Second)))
+		writeJSONError(w, http.StatusTooManyRequests, err)
+	case err == errBreakerOpen:
+		w.Header().Set("Retry-After", strconv.Itoa(int(breaker.retryAfter()/time.Second)))
+		writeJSONError(w, http.StatusServiceUnavailable, err)
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, err)
+	case streamed:
+		// The pages were already streamed as they arrived.
+		items = countItems(kv.Value)
+		_ = ps.finish(q.continuationToken(kv.NextPageToken), suggestFor(ctx, q, items))
+		succeeded = true
+		recordSearchServed(ctx, kv, items, start)
+	default:
+		items = countItems(kv.Value)
+		writeResults(kv, suggestFor(ctx, q, items))
+		succeeded = true
+		recordSearchServed(ctx, kv, items, start)
+	}
+}
+
+// resultsEnvelope is the body of plain JSON responses to requests with the
+// "envelope=1" URL parameter. It carries the continuation token and any
+// suggestions alongside the result pages, which are otherwise the whole body.
+type resultsEnvelope struct {
+	Results      json.RawMessage `json:"results"`
+	Continuation string          `json:"continuation,omitempty"`
+	Suggestions  []string        `json:"suggestions,omitempty"`
+}
+
+// lookupOrFetch returns the results for q from the cache or else from the
+// provider, in which case onPage, if set, is invoked with each page as soon
+// as it arrives. streamed reports whether onPage was invoked with all the
+// results, which it isn't if they were cached or fetched by another caller.
+func lookupOrFetch(ctx context.Context, q *query, onPage func(*youtube.SearchPage)) (kv *dbCacheKV, streamed bool, err error) {
+	span := trace.FromContext(ctx)
+	cacheKey := q.cacheKey()
+	ctx, _ = tag.New(ctx, tag.Upsert(cacheBackendKey, resultCache.Name()))
 
 	span.Annotate([]trace.Attribute{
-		trace.StringAttribute("db", "mongodb"),
-		trace.StringAttribute("driver", "go"),
+		trace.StringAttribute("cache_backend", resultCache.Name()),
 	}, "Checking cache if the query is present")
 
-	dbRes := ytSearchesCollection.FindOne(ctx, filter)
 	// 1. Firstly check if this has been cached before
-	cachedKV := new(dbCacheKV)
-
-	switch err := dbRes.Decode(cachedKV); err {
+	cachedKV, err := resultCache.Get(ctx, cacheKey)
+	// expiredKV is the cached result if it is too old to be served
+	// unless the provider turns out to be unavailable.
+	var expiredKV *dbCacheKV
+	switch err {
 	default:
-		stats.Record(ctx, mongoErrors.M(1))
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		// The cache is only an optimization, so search on without it.
+		span.Annotate([]trace.Attribute{
+			trace.StringAttribute("error", err.Error()),
+		}, "Cache lookup failed, treating it as a miss")
+		stats.Record(ctx, cacheLookupErrors.M(1))
 
 	case nil: // Cache hit!
-		if !reflect.DeepEqual(cachedKV, blankDBKV) {
+		age := time.Since(cachedKV.CacheTime)
+		stats.Record(ctx, cacheAge.M(age.Seconds()))
+
+		switch {
+		case age <= cacheTTL:
 			span.Annotate([]trace.Attribute{
 				trace.BoolAttribute("hit", true),
-				trace.StringAttribute("db", "mongodb"),
-				trace.StringAttribute("driver", "go"),
+				trace.StringAttribute("cache_backend", resultCache.Name()),
 			}, "Cache hit")
 			stats.Record(ctx, cacheHits.M(1))
-			w.Write(cachedKV.Value)
-			return
+			return cachedKV, false, nil
+
+		case age <= cacheTTL+cacheStaleTTL:
+			span.Annotate([]trace.Attribute{
+				trace.BoolAttribute("hit", true),
+				trace.BoolAttribute("stale", true),
+				trace.Int64Attribute("age_seconds", int64(age/time.Second)),
+			}, "Stale cache hit, serving it while refreshing in the background")
+			stats.Record(ctx, cacheHits.M(1), cacheStaleServed.M(1))
+			switch {
+			case quota != nil && quota.nearlyExhausted():
+				span.Annotate(nil, "Not refreshing since the YouTube API quota is nearly exhausted")
+			case breaker.isOpen():
+				span.Annotate(nil, "Not refreshing since the circuit breaker is open")
+			default:
+				refreshInBackground(ctx, q)
+			}
+			cachedKV.stale = true
+			return cachedKV, false, nil
+
+		case breaker.isOpen():
+			// Rather an old result than none while the provider is down.
+			span.Annotate([]trace.Attribute{
+				trace.BoolAttribute("hit", true),
+				trace.BoolAttribute("stale", true),
+				trace.Int64Attribute("age_seconds", int64(age/time.Second)),
+			}, "Expired cache hit, serving it since the circuit breaker is open")
+			stats.Record(ctx, cacheHits.M(1), cacheStaleServed.M(1))
+			cachedKV.stale = true
+			return cachedKV, false, nil
 		}
 
-		// Otherwise this is false cache hit!
+		// The entry is too old to be served but it is kept, to be
+		// replaced by the fetch below or served if that can't be made.
+		span.Annotate([]trace.Attribute{
+			trace.Int64Attribute("age_seconds", int64(age/time.Second)),
+		}, "Expired cache entry")
+		expiredKV = cachedKV
 
-	case bson.ErrElementNotFound, mongo.ErrNoDocuments:
+	case errCacheMiss:
 		// Cache miss, now retrieve the results below
 	}
 
 	// 2. Otherwise that was a cache-miss, now retrieve it then save it
 	stats.Record(ctx, cacheMisses.M(1))
 
+	if quota != nil && quota.nearlyExhausted() {
+		span.Annotate([]trace.Attribute{
+			trace.BoolAttribute("hit", false),
+		}, "Cache miss but the YouTube API quota is nearly exhausted")
+		stats.Record(ctx, quotaRejections.M(1))
+		return nil, false, errQuotaExhausted
+	}
+
 	span.Annotate([]trace.Attribute{
 		trace.BoolAttribute("hit", false),
-		trace.StringAttribute("db", "mongodb"),
-		trace.StringAttribute("driver", "go"),
+		trace.StringAttribute("cache_backend", resultCache.Name()),
 	}, "Cache miss, hence YouTube API search")
 
-	pagesChan, err := yc.Search(ctx, &youtube.SearchParam{
-		Query:             keywords,
-		MaxPage:           uint64(q.MaxPages),
-		MaxResultsPerPage: uint64(q.MaxPerPage),
+	// 3. Concurrent misses for the same query share one upstream
+	// call, which caches the results so next time it'll be a hit.
+	kv, err, shared := searchGroup.Do(ctx, cacheKey, func(ctx context.Context) (*dbCacheKV, error) {
+		return fetchAndCache(ctx, q, cacheKey, onPage)
 	})
+	if err == errBreakerOpen && expiredKV != nil {
+		// The breaker opened, or refused a probe, since it was checked.
+		span.Annotate(nil, "Serving the expired cache entry since the circuit breaker is open")
+		stats.Record(ctx, cacheStaleServed.M(1))
+		expiredKV.stale = true
+		return expiredKV, false, nil
+	}
 	if err != nil {
-		stats.Record(ctx, youtubeAPIErrors.M(1))
-		span.Annotate([]trace.Attribute{
-			trace.StringAttribute("api_error", err.Error()),
-			trace.StringAttribute("db", "mongodb"),
-			trace.StringAttribute("driver", "go"),
-		}, "YouTube API search error")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, false, err
 	}
+	return kv, onPage != nil && !shared, nil
+}
 
-	var pages []*youtube.SearchPage
-	for page := range pagesChan {
-		pages = append(pages, page)
+// fetchAndCache retrieves the results for q from the provider, invoking
+// onPage if set as each page arrives, and then caches all of them.
+func fetchAndCache(ctx context.Context, q *query, cacheKey string, onPage func(*youtube.SearchPage)) (*dbCacheKV, error) {
+	// The provider is asked for the normalized keywords since
+	// the results are cached under them for all their variants.
+	pages, nextPageToken, err := searchProvider(ctx, &searchParam{
+		SearchParam: youtube.SearchParam{
+			Query:             normalizeKeywords(q.Keywords),
+			MaxPage:           uint64(q.MaxPages),
+			MaxResultsPerPage: uint64(q.MaxPerPage),
+		},
+		searchFilters: q.searchFilters,
+	}, q.pageToken, onPage)
+	if err != nil {
+		return nil, err
 	}
 	outBlob, err := json.Marshal(pages)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
+	recordVideos(ctx, pages)
+	kv := &dbCacheKV{Key: cacheKey, Value: outBlob, NextPageToken: nextPageToken}
+	_ = resultCache.Set(ctx, kv, cacheTTL+cacheStaleTTL+cacheRetainTTL)
+	kv.fromUpstream = true
+	return kv, nil
+}
 
-	// 3. Now cache it so that next time it'll be a hit.
-	insertKV := &dbCacheKV{
-		Key:       keywords,
-		Value:     outBlob,
-		CacheTime: time.Now(),
-	}
+// refreshInBackground fetches q anew and replaces its stale cache entry.
+// The refresh outlives the request so it runs in its own trace that
+// links back to the request that triggered it. A burst of stale hits
+// only triggers one upstream call since the refreshes are coalesced.
+func refreshInBackground(ctx context.Context, q *query) {
+	cacheKey := q.cacheKey()
+	parentSC := trace.FromContext(ctx).SpanContext()
+	bgCtx := tag.NewContext(context.Background(), tag.FromContext(ctx))
+	go func() {
+		ctx, span := trace.StartSpan(bgCtx, "/refresh-stale-cache")
+		defer span.End()
+		span.AddLink(trace.Link{
+			TraceID: parentSC.TraceID,
+			SpanID:  parentSC.SpanID,
+			Type:    trace.LinkTypeParent,
+		})
+
+		_, err, _ := searchGroup.Do(ctx, cacheKey, func(ctx context.Context) (*dbCacheKV, error) {
+			return fetchAndCache(ctx, q, cacheKey, nil)
+		})
+		if err != nil {
+			span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+		}
+	}()
+}
 
-	if _, err := ytSearchesCollection.InsertOne(ctx, insertKV); err != nil {
-		stats.Record(ctx, cacheInsertionErrors.M(1))
-	}
+// searchProvider retrieves up to param.MaxPage pages for param from the
+// configured provider, starting at pageToken, and returns them along with
+// the token of the page after the last. It tags its errors and spans with
+// the provider's name. If set, onPage is invoked with each page as soon
+// as it arrives.
+func searchProvider(ctx context.Context, param *searchParam, pageToken string, onPage func(*youtube.SearchPage)) ([]*youtube.SearchPage, string, error) {
+	ctx, span := trace.StartSpan(ctx, "/provider-search")
+	defer span.End()
 
-	_, _ = w.Write(outBlob)
+	span.AddAttributes(trace.StringAttribute("provider", provider.Name()))
+	ctx, _ = tag.New(ctx, tag.Upsert(providerKey, provider.Name()))
+	start := time.Now()
+	defer func() { stats.Record(ctx, upstreamFetchLatency.M(sinceMillis(start))) }()
+
+	var pages []*youtube.SearchPage
+	for i := uint64(0); i < param.MaxPage; i++ {
+		page, nextPageToken, err := provider.Page(ctx, param, pageToken)
+		if err != nil {
+			if err != errBreakerOpen && err != errQuotaExhausted {
+				stats.Record(ctx, youtubeAPIErrors.M(1))
+			}
+			span.Annotate([]trace.Attribute{
+				trace.StringAttribute("api_error", err.Error()),
+				trace.StringAttribute("provider", provider.Name()),
+			}, "Search provider error")
+			return nil, "", err
+		}
+		if onPage != nil {
+			onPage(page)
+		}
+		pages = append(pages, page)
+		pageToken = nextPageToken
+		if pageToken == "" {
+			break
+		}
+	}
+	return pages, pageToken, nil
 }
 
 var (
 	cacheHits   = stats.Int64("cache_hits", "the number of cache hits", stats.UnitNone)
 	cacheMisses = stats.Int64("cache_misses", "the number of cache misses", stats.UnitNone)
 
+	cacheStaleServed = stats.Int64("cache_stale_served", "the number of stale cache results served", stats.UnitNone)
+	cacheAge         = stats.Float64("cache_age", "the age of cached results when they are read", "s")
+
 	cacheInsertionErrors = stats.Int64("cache_insertion_errors", "the number of cache insertion errors", stats.UnitNone)
+	cacheLookupErrors    = stats.Int64("cache_lookup_errors", "the number of cache lookup errors", stats.UnitNone)
 
 	youtubeAPIErrors = stats.Int64("youtube_api_errors", "the number of youtube API lookup errors", stats.UnitNone)
 	mongoErrors      = stats.Int64("mongo_errors", "the number of MongoDB errors", stats.UnitNone)
-
-	blankDBKV = new(dbCacheKV)
 )
 
-func parseJSON(ctx context.Context, r io.Reader, recv interface{}) error {
-	ctx, span := trace.StartSpan(ctx, "/parse-json")
-	span.End()
+// cacheKey returns the canonical key under which the results for q are
+// cached. It includes every parameter that changes the results, so any
+// new query parameter must be added here too.
+func (q *query) cacheKey() string {
+	values := make(url.Values)
+	values.Set("max_per_page", strconv.FormatInt(q.MaxPerPage, 10))
+	values.Set("max_pages", strconv.FormatInt(q.MaxPages, 10))
+	q.searchFilters.addTo(values)
+	if q.pageToken != "" {
+		values.Set("page_token", q.pageToken)
+	}
+	// The keywords go first so that entries can be listed and
+	// invalidated by keyword prefix. Encode sorts the rest by
+	// key so the result is stable.
+	return keywordsKeyPrefix(q.Keywords) + "&" + values.Encode()
+}
+
+// keywordsKeyPrefix returns the start of the cache keys of the
+// searches whose normalized keywords start with those of keywords.
+func keywordsKeyPrefix(keywords string) string {
+	return "q=" + url.QueryEscape(normalizeKeywords(keywords))
+}
+
+// resolveContinuation returns the query for the
+// page after the one that q's continuation token
+// was handed out with. That query is for a single
+// page so that clients can load more incrementally.
+func (q *query) resolveContinuation() (*query, error) {
+	c, err := signer.decode(q.Continuation)
+	if err != nil {
+		return nil, err
+	}
+	next := c.Query
+	next.MaxPages = 1
+	next.pageToken = c.PageToken
+	next.setDefaultLimits()
+	return next, nil
+}
 
-	blob, err := ioutil.ReadAll(r)
+// continuationToken returns the token with which clients can request the
+// page at nextPageToken, following the results for q, or "" if there is none.
+func (q *query) continuationToken(nextPageToken string) string {
+	if nextPageToken == "" {
+		return ""
+	}
+	next := *q
+	next.Continuation = ""
+	token, err := signer.encode(&continuation{Query: &next, PageToken: nextPageToken})
 	if err != nil {
-		return err
+		log.Printf("Failed to encode a continuation token: %v", err)
+		return ""
 	}
-	return json.Unmarshal(blob, recv)
+	return token
 }
 
 func (q *query) setDefaultLimits() {
@@ -0,0 +1,362 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	ytv3 "google.golang.org/api/youtube/v3"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/trace"
+
+	"github.com/orijtech/youtube"
+)
+
+var (
+	// testServer serves the routes, set up against fakeYouTube and an
+	// in-memory cache without MongoDB or the thumbnail cache.
+	testServer       *httptest.Server
+	fakeYouTube      *fakeSearchAPI
+	testExporter     *memoryExporter
+	testViewExporter *memoryViewExporter
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	fakeYouTube = &fakeSearchAPI{calls: make(map[string]int)}
+	upstream := httptest.NewServer(fakeYouTube)
+	svc, err := ytv3.New(&http.Client{Transport: &ochttp.Transport{}})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Creating the YouTube service: %v\n", err)
+		os.Exit(1)
+	}
+	svc.BasePath = upstream.URL + "/youtube/v3/"
+	lru, err := newLRUCache(100)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Creating the LRU cache: %v\n", err)
+		os.Exit(1)
+	}
+	testExporter = new(memoryExporter)
+	testViewExporter = &memoryViewExporter{data: make(map[string]*view.Data)}
+
+	testCfg := *cfg
+	testCfg.quotaBudget = 0
+	testCfg.tokenSecret = "test"
+	setup(&testCfg, &dependencies{
+		traceExporters: []trace.Exporter{testExporter},
+		viewExporters:  []view.Exporter{testViewExporter},
+		provider:       &youtubeProvider{svc: svc},
+		cache:          &instrumentedCache{lru},
+	})
+	// Export views often, so that the tests needn't wait long for them.
+	view.SetReportingPeriod(20 * time.Millisecond)
+	testServer = httptest.NewServer(newHandler())
+
+	code := m.Run()
+	testServer.Close()
+	upstream.Close()
+	os.Exit(code)
+}
+
+// fakeSearchAPI fakes the YouTube search API, responding to every
+// query with two videos and counting the calls made for each query.
+type fakeSearchAPI struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (fs *fakeSearchAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/youtube/v3/search" {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query().Get("q")
+	fs.mu.Lock()
+	fs.calls[q]++
+	fs.mu.Unlock()
+
+	res := &ytv3.SearchListResponse{Kind: "youtube#searchListResponse"}
+	for i, id := range []string{"dQw4w9WgXcQ", "9bZkp7q19f0"} {
+		res.Items = append(res.Items, &ytv3.SearchResult{
+			Kind: "youtube#searchResult",
+			Id:   &ytv3.ResourceId{Kind: "youtube#video", VideoId: id},
+			Snippet: &ytv3.SearchResultSnippet{
+				Title: fmt.Sprintf("%s #%d", q, i+1),
+				Thumbnails: &ytv3.ThumbnailDetails{
+					Default: &ytv3.Thumbnail{Url: "https://i.ytimg.com/vi/" + id + "/default.jpg"},
+				},
+			},
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func (fs *fakeSearchAPI) callsFor(q string) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.calls[q]
+}
+
+func TestRepeatedSearchesAreCached(t *testing.T) {
+	const q = "look alive"
+	start := time.Now()
+	hits, misses := exportedCount(t, "cache_hits", start), exportedCount(t, "cache_misses", start)
+
+	for i := 0; i < 3; i++ {
+		mustSearch(t, q)
+	}
+
+	if n := fakeYouTube.callsFor(q); n != 1 {
+		t.Errorf("The fake YouTube API was called %d times, want 1", n)
+	}
+	// The counts are only exported periodically, so wait for them.
+	var gotHits, gotMisses int64
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		gotHits = exportedCount(t, "cache_hits", start) - hits
+		gotMisses = exportedCount(t, "cache_misses", start) - misses
+		if gotHits == 2 && gotMisses == 1 {
+			break
+		}
+	}
+	if gotHits != 2 {
+		t.Errorf("Got %d cache hits, want 2", gotHits)
+	}
+	if gotMisses != 1 {
+		t.Errorf("Got %d cache misses, want 1", gotMisses)
+	}
+}
+
+func TestSearchSpans(t *testing.T) {
+	testExporter.reset()
+	for i := 0; i < 3; i++ {
+		mustSearch(t, "sql tutorial")
+	}
+
+	// Spans are exported as they end, which may be after the
+	// response has been received, so wait for all of them.
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if err = checkSearchTraces(testExporter.spanData(), 3); err == nil {
+			return
+		}
+	}
+	t.Fatal(err)
+}
+
+func TestSearchEnvelope(t *testing.T) {
+	res, err := http.Get(testServer.URL + "/search?envelope=1&max_per_page=2&q=" + url.QueryEscape("look alive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var envelope struct {
+		Results     []*youtube.SearchPage `json:"results"`
+		Suggestions []string              `json:"suggestions"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&envelope); err != nil {
+		t.Fatal(err)
+	}
+	if len(envelope.Results) != 1 || len(envelope.Results[0].Items) != 2 {
+		t.Errorf("Got %d pages, want 1 page of 2 results", len(envelope.Results))
+	}
+	if len(envelope.Suggestions) != 0 {
+		t.Errorf("Got suggestions %q for a query that found results", envelope.Suggestions)
+	}
+}
+
+func TestRoutesWithoutDependencies(t *testing.T) {
+	paths := []string{
+		"/history", "/trending", "/saved", "/favorites",
+		"/videos/dQw4w9WgXcQ", "/thumb/dQw4w9WgXcQ/default",
+	}
+	for _, path := range paths {
+		res, err := http.Get(testServer.URL + path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s: got status %s, want 503 Service Unavailable", path, res.Status)
+		}
+	}
+}
+
+func mustSearch(t *testing.T, q string) {
+	t.Helper()
+
+	res, err := http.Get(testServer.URL + "/search?max_per_page=2&q=" + url.QueryEscape(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Got status %s, want 200 OK", res.Status)
+	}
+	var pages []*youtube.SearchPage
+	if err := json.NewDecoder(res.Body).Decode(&pages); err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 || len(pages[0].Items) != 2 {
+		t.Fatalf("Got %d pages, want 1 page of 2 results", len(pages))
+	}
+}
+
+// exportedCount sums the rows of the count view with the name, as
+// last exported, waiting for it to have been exported since then.
+func exportedCount(t *testing.T, name string, since time.Time) int64 {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if n, ok := testViewExporter.count(name, since); ok {
+			return n
+		}
+	}
+	t.Fatalf("%q wasn't exported since %v", name, since)
+	return 0
+}
+
+// checkSearchTraces checks that each of the searches was traced with a
+// /search span, holding a parseQuery span, and that only the first one,
+// which missed the cache, went on to call the provider after parsing.
+func checkSearchTraces(spans []*trace.SpanData, searches int) error {
+	byID := make(map[trace.SpanID]*trace.SpanData)
+	for _, sd := range spans {
+		byID[sd.SpanID] = sd
+	}
+	// descends reports whether sd is beneath ancestor.
+	descends := func(sd, ancestor *trace.SpanData) bool {
+		for parent, ok := byID[sd.ParentSpanID]; ok; parent, ok = byID[parent.ParentSpanID] {
+			if parent.SpanID == ancestor.SpanID {
+				return true
+			}
+		}
+		return false
+	}
+
+	var parses []*trace.SpanData
+	for _, sd := range spans {
+		if sd.Name == "parseQuery" {
+			parses = append(parses, sd)
+		}
+	}
+	if len(parses) != searches {
+		return fmt.Errorf("got %d parseQuery spans, want %d", len(parses), searches)
+	}
+	sort.Slice(parses, func(i, j int) bool { return parses[i].StartTime.Before(parses[j].StartTime) })
+
+	for i, parse := range parses {
+		searchSpan, ok := byID[parse.ParentSpanID]
+		if !ok || searchSpan.Name != "/search" {
+			return fmt.Errorf("search #%d: parseQuery isn't beneath a /search span", i+1)
+		}
+		var providerSpans []*trace.SpanData
+		for _, sd := range spans {
+			if sd.Name == "/provider-search" && descends(sd, searchSpan) {
+				providerSpans = append(providerSpans, sd)
+			}
+		}
+
+		if i > 0 {
+			// The rest were cache hits.
+			if len(providerSpans) != 0 {
+				return fmt.Errorf("search #%d: got a /provider-search span for a cached search", i+1)
+			}
+			continue
+		}
+		if len(providerSpans) != 1 {
+			return fmt.Errorf("search #1: got %d /provider-search spans beneath /search, want 1", len(providerSpans))
+		}
+		if providerSpans[0].StartTime.Before(parse.EndTime) {
+			return fmt.Errorf("search #1: /provider-search started before parseQuery ended")
+		}
+	}
+	return nil
+}
+
+// memoryExporter keeps the spans exported to it in memory.
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+var _ trace.Exporter = (*memoryExporter)(nil)
+
+func (me *memoryExporter) ExportSpan(sd *trace.SpanData) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.spans = append(me.spans, sd)
+}
+
+func (me *memoryExporter) spanData() []*trace.SpanData {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return append([]*trace.SpanData(nil), me.spans...)
+}
+
+func (me *memoryExporter) reset() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.spans = nil
+}
+
+// memoryViewExporter keeps the data last exported to it for each view.
+type memoryViewExporter struct {
+	mu   sync.Mutex
+	data map[string]*view.Data
+}
+
+var _ view.Exporter = (*memoryViewExporter)(nil)
+
+func (me *memoryViewExporter) ExportView(vd *view.Data) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.data[vd.View.Name] = vd
+}
+
+// count sums the rows of the count view with the name, as long as it
+// has been exported since then.
+func (me *memoryViewExporter) count(name string, since time.Time) (int64, bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	vd, ok := me.data[name]
+	if !ok || vd.End.Before(since) {
+		return 0, false
+	}
+	var n int64
+	for _, row := range vd.Rows {
+		if data, ok := row.Data.(*view.CountData); ok {
+			n += data.Value
+		}
+	}
+	return n, true
+}
@@ -1,13 +1,36 @@
 var nodes = {
 	searchInput: document.querySelector('.js-search-input'),
+	filterType: document.querySelector('.js-filter-type'),
+	filterPublishedAfter: document.querySelector('.js-filter-published-after'),
+	filterVideoDuration: document.querySelector('.js-filter-video-duration'),
+	filterRegionCode: document.querySelector('.js-filter-region-code'),
+	filterRelevanceLanguage: document.querySelector('.js-filter-relevance-language'),
+	filterSafeSearch: document.querySelector('.js-filter-safe-search'),
 	searchButton: document.querySelector('.js-search-button'),
 	searchSection: document.querySelector('.js-search-section'),
 	resultsSection: document.querySelector('.js-results-section'),
+	loadMoreButton: document.querySelector('.js-load-more-button'),
+	suggestions: document.querySelector('.js-suggestions'),
+	saveSearchButton: document.querySelector('.js-save-search-button'),
+	savedPanel: document.querySelector('.js-saved-panel'),
+	savedList: document.querySelector('.js-saved-list'),
+	favoritesPanel: document.querySelector('.js-favorites-panel'),
+	favoritesList: document.querySelector('.js-favorites-list'),
 	loader: document.querySelector('.js-loader')
 };
 
 var isSearching = false;
 var searchResults = [];
+// The token for the page after the ones shown, if there are more.
+var continuation = '';
+
+// Identifies this browser to the server so that saved
+// searches and favorites are kept per user.
+var userID = localStorage.getItem('mediaSearchUserID');
+if (!userID) {
+	userID = 'user-' + Math.random().toString(36).slice(2);
+	localStorage.setItem('mediaSearchUserID', userID);
+}
 
 // Basic HTTP request method
 function sendRequest(object) {
@@ -22,6 +45,7 @@ function sendRequest(object) {
 
 	xhr.open(method, url);
 	xhr.setRequestHeader('Access-Control-Allow-Origin', '*');
+	xhr.setRequestHeader('X-MEDIA-SEARCH-USERID', userID);
 
 	if (usesJson) {
 		xhr.setRequestHeader('Content-Type', 'application/json');
@@ -29,8 +53,8 @@ function sendRequest(object) {
 
 	xhr.onreadystatechange = function() {
 		if (xhr.readyState === 4) {
-			if (xhr.status === 200) {
-				return successCallback(JSON.parse(xhr.responseText));
+			if (xhr.status >= 200 && xhr.status < 300) {
+				return successCallback(xhr.responseText ? JSON.parse(xhr.responseText) : null);
 			} else {
 				return errorCallback(xhr.status);
 			}
@@ -44,6 +68,81 @@ function sendRequest(object) {
 	}
 }
 
+// Streams the NDJSON response of a POST request, invoking
+// pageCallback with each page as soon as it has arrived and
+// doneCallback with the continuation token and the suggested
+// queries, if any, at the end.
+function streamRequest(object) {
+	var pageCallback = object.pageCallback,
+		doneCallback = object.doneCallback,
+		errorCallback = object.errorCallback,
+		xhr = new XMLHttpRequest(),
+		consumed = 0,
+		token = '',
+		suggestions = [],
+		failed = false;
+
+	xhr.open('POST', object.url);
+	xhr.setRequestHeader('Content-Type', 'application/json');
+	xhr.setRequestHeader('Accept', 'application/x-ndjson');
+	xhr.setRequestHeader('X-MEDIA-SEARCH-USERID', userID);
+
+	// Handles every complete line received since the last call.
+	function consumeLines() {
+		var lastNewline = xhr.responseText.lastIndexOf('\n');
+		if (lastNewline < consumed) {
+			return;
+		}
+
+		var lines = xhr.responseText.slice(consumed, lastNewline).split('\n');
+		consumed = lastNewline + 1;
+		lines.forEach(function(line) {
+			if (failed || !line.trim()) {
+				return;
+			}
+			var parsed = JSON.parse(line);
+			if (parsed.error) {
+				failed = true;
+				return errorCallback(parsed.error);
+			}
+			// The last line carries the continuation token and, when
+			// nothing was found, the queries to suggest instead.
+			if (parsed.continuation || parsed.suggestions) {
+				token = parsed.continuation || '';
+				suggestions = parsed.suggestions || [];
+				return;
+			}
+			pageCallback(parsed);
+		});
+	}
+
+	xhr.onprogress = function() {
+		if (xhr.status === 200) {
+			consumeLines();
+		}
+	};
+
+	xhr.onreadystatechange = function() {
+		if (xhr.readyState !== 4) {
+			return;
+		}
+		if (xhr.status !== 200) {
+			// Errors are JSON objects like {"error": "...", "fields": [...]}.
+			var message = 'Request failed with status ' + xhr.status;
+			try {
+				message = JSON.parse(xhr.responseText).error || message;
+			} catch (e) {}
+			return errorCallback(message);
+		}
+		consumeLines();
+		if (!failed) {
+			doneCallback(token, suggestions);
+		}
+	};
+
+	xhr.send(JSON.stringify(object.data));
+}
+
 function collapseSearchSection() {
 	if (nodes.searchSection.classList.contains('search-section-collapsed')) {
 		return;
@@ -59,9 +158,13 @@ function clearResults() {
 	});
 }
 
-function onSearchBegin() {
+function onSearchBegin(keepResults) {
 	collapseSearchSection();
-	clearResults();
+	if (!keepResults) {
+		clearResults();
+	}
+	nodes.loadMoreButton.classList.add('hidden');
+	nodes.suggestions.classList.add('hidden');
 	nodes.loader.classList.remove('hidden');
 	isSearching = true;
 }
@@ -90,15 +193,23 @@ function appendResult(result) {
 	p.textContent = result.title;
 
 	div.appendChild(anchor);
+	if (result.videoId) {
+		var star = document.createElement('button');
+		star.classList.add('favorite-button');
+		star.title = 'Add to favorites';
+		star.innerHTML = '<i class="material-icons">star</i>';
+		star.addEventListener('click', function() {
+			addFavorite(result);
+		});
+		div.appendChild(star);
+	}
 	div.appendChild(imgDiv);
 	div.appendChild(p);
 	nodes.resultsSection.appendChild(div);
 }
 
-function successCallback(response) {
-	onSearchEnd();
-
-	var results = response[0].Items.map(function(item) {
+function pageCallback(page) {
+	var results = (page.Items || []).map(function(item) {
 		var url = 'https://youtube.com/';
 		if (item.id.videoId) {
 			url = url + 'watch?v=' + item.id.videoId;
@@ -108,8 +219,12 @@ function successCallback(response) {
 
 		return {
 			url: url,
+			videoId: item.id.videoId,
 			title: item.snippet.title,
-			thumbnail: item.snippet.thumbnails.default.url
+			// Video thumbnails go through the server's traced and cached proxy.
+			thumbnail: item.id.videoId ?
+				'http://localhost:9778/thumb/' + item.id.videoId + '/medium?w=480' :
+				item.snippet.thumbnails.default.url
 		};
 	});
 
@@ -118,27 +233,211 @@ function successCallback(response) {
 	});
 }
 
-function errorCallback() {
+function doneCallback(token, suggestions) {
+	onSearchEnd();
+	continuation = token;
+	if (continuation) {
+		nodes.loadMoreButton.classList.remove('hidden');
+	}
+	if (suggestions && suggestions.length) {
+		showSuggestions(suggestions);
+	}
+}
+
+// Offers queries that found results to try instead of
+// one that found nothing.
+function showSuggestions(suggestions) {
+	nodes.suggestions.textContent = 'Did you mean: ';
+	suggestions.forEach(function(suggestion, i) {
+		var anchor = document.createElement('a');
+		anchor.textContent = suggestion;
+		anchor.addEventListener('click', function() {
+			nodes.searchInput.value = suggestion;
+			runSearch(addFilters({"q": suggestion}));
+		});
+		if (i > 0) {
+			nodes.suggestions.appendChild(document.createTextNode(', '));
+		}
+		nodes.suggestions.appendChild(anchor);
+	});
+	nodes.suggestions.appendChild(document.createTextNode('?'));
+	nodes.suggestions.classList.remove('hidden');
+}
+
+function errorCallback(message) {
 	onSearchEnd();
-	alert('Something went wrong.');
+	alert('Something went wrong: ' + message);
+}
+
+// Adds the filters that have been set to the search request data.
+function addFilters(data) {
+	var filters = {
+		type: nodes.filterType.value,
+		videoDuration: nodes.filterVideoDuration.value,
+		regionCode: nodes.filterRegionCode.value.trim(),
+		relevanceLanguage: nodes.filterRelevanceLanguage.value.trim(),
+		safeSearch: nodes.filterSafeSearch.value
+	};
+	if (nodes.filterPublishedAfter.value) {
+		filters.publishedAfter = new Date(nodes.filterPublishedAfter.value).toISOString();
+	}
+	// YouTube only filters by duration when searching for videos.
+	if (filters.videoDuration && !filters.type) {
+		filters.type = 'video';
+	}
+
+	Object.keys(filters).forEach(function(key) {
+		if (filters[key]) {
+			data[key] = filters[key];
+		}
+	});
+	return data;
 }
 
 function onSearchClick() {
+	runSearch(addFilters({"q": nodes.searchInput.value.trim()}));
+}
+
+function runSearch(data) {
 	if (isSearching) {
 		return;
 	}
 
 	onSearchBegin();
 
-	var query = nodes.searchInput.value.trim();
+	streamRequest({
+		data: data,
+		url: 'http://localhost:9778/search',
+		pageCallback: pageCallback,
+		doneCallback: doneCallback,
+		errorCallback: errorCallback
+	});
+}
+
+function onLoadMoreClick() {
+	if (isSearching || !continuation) {
+		return;
+	}
+
+	onSearchBegin(true);
+
+	streamRequest({
+		data: {"continuation": continuation},
+		url: 'http://localhost:9778/search',
+		pageCallback: pageCallback,
+		doneCallback: doneCallback,
+		errorCallback: errorCallback
+	});
+}
+
+// Adds an item to a panel's list, with an x that invokes onRemove.
+function appendPanelItem(list, label, onClick, onRemove, badge) {
+	var li = document.createElement('li');
+	var anchor = document.createElement('a');
+	var remove = document.createElement('button');
+
+	anchor.textContent = label;
+	anchor.addEventListener('click', onClick);
+	li.appendChild(anchor);
+	if (badge) {
+		var span = document.createElement('span');
+		span.classList.add('panel-badge');
+		span.textContent = badge;
+		li.appendChild(span);
+	}
+	remove.classList.add('panel-remove');
+	remove.title = 'Remove';
+	remove.textContent = '\u2715';
+	remove.addEventListener('click', onRemove);
+	li.appendChild(remove);
+	list.appendChild(li);
+}
 
+function loadSaved() {
+	sendRequest({
+		method: 'GET',
+		url: 'http://localhost:9778/saved',
+		successCallback: function(searches) {
+			nodes.savedList.innerHTML = '';
+			(searches || []).forEach(function(search) {
+				var count = (search.new_results || []).length;
+				appendPanelItem(nodes.savedList, search.q, function() {
+					var data = {"q": search.q};
+					Object.keys(search.filters || {}).forEach(function(key) {
+						var value = search.filters[key];
+						// Unset publication dates come back as the zero time.
+						if (value && !(key === 'publishedAfter' && value.indexOf('0001-') === 0)) {
+							data[key] = value;
+						}
+					});
+					nodes.searchInput.value = search.q;
+					runSearch(data);
+				}, function() {
+					sendRequest({
+						method: 'DELETE',
+						url: 'http://localhost:9778/saved?id=' + encodeURIComponent(search.id),
+						successCallback: loadSaved,
+						errorCallback: errorCallback
+					});
+				}, count ? count + ' new' : '');
+			});
+		},
+		errorCallback: errorCallback
+	});
+}
+
+function loadFavorites() {
+	sendRequest({
+		method: 'GET',
+		url: 'http://localhost:9778/favorites',
+		successCallback: function(favorites) {
+			nodes.favoritesList.innerHTML = '';
+			(favorites || []).forEach(function(favorite) {
+				appendPanelItem(nodes.favoritesList, favorite.title || favorite.video_id, function() {
+					window.open('https://youtube.com/watch?v=' + favorite.video_id);
+				}, function() {
+					sendRequest({
+						method: 'DELETE',
+						url: 'http://localhost:9778/favorites?video_id=' + encodeURIComponent(favorite.video_id),
+						successCallback: loadFavorites,
+						errorCallback: errorCallback
+					});
+				});
+			});
+		},
+		errorCallback: errorCallback
+	});
+}
+
+function addFavorite(result) {
 	sendRequest({
 		method: 'POST',
-		data: {"q": query},
-		url: 'http://localhost:9778/search',
-		successCallback: successCallback,
+		url: 'http://localhost:9778/favorites',
+		data: {video_id: result.videoId, title: result.title, thumbnail: result.thumbnail},
+		successCallback: loadFavorites,
+		errorCallback: errorCallback
+	});
+}
+
+function onSaveSearchClick() {
+	var query = nodes.searchInput.value.trim();
+	if (!query) {
+		return;
+	}
+	sendRequest({
+		method: 'POST',
+		url: 'http://localhost:9778/saved',
+		data: addFilters({"q": query}),
+		successCallback: function() {
+			nodes.savedPanel.open = true;
+			loadSaved();
+		},
 		errorCallback: errorCallback
 	});
 }
 
 nodes.searchButton.addEventListener('click', onSearchClick)
+nodes.loadMoreButton.addEventListener('click', onLoadMoreClick)
+nodes.saveSearchButton.addEventListener('click', onSaveSearchClick)
+loadSaved();
+loadFavorites();
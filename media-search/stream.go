@@ -0,0 +1,149 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/orijtech/youtube"
+)
+
+const (
+	// streamNDJSON writes each page as a line of JSON.
+	streamNDJSON = "ndjson"
+	// streamSSE writes each page as a Server-Sent Event.
+	streamSSE = "sse"
+)
+
+// streamFormat returns the format in which the results for req should be
+// streamed, or "" if they should be written in one go. Streaming is selected
+// by the Accept header or by the "stream=1" URL parameter, which defaults
+// to NDJSON.
+func streamFormat(req *http.Request) string {
+	accept := req.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/event-stream"):
+		return streamSSE
+	case strings.Contains(accept, "application/x-ndjson"):
+		return streamNDJSON
+	case req.URL.Query().Get("stream") == "1":
+		return streamNDJSON
+	default:
+		return ""
+	}
+}
+
+// pageStreamer writes result pages to the client as they become available.
+type pageStreamer struct {
+	w      http.ResponseWriter
+	format string
+	// started reports whether the headers have been written,
+	// after which errors can only be reported in the stream.
+	started bool
+	pages   int
+}
+
+func newPageStreamer(w http.ResponseWriter, req *http.Request) *pageStreamer {
+	format := streamFormat(req)
+	if format == "" {
+		return nil
+	}
+	return &pageStreamer{w: w, format: format}
+}
+
+func (ps *pageStreamer) writeHeaders() {
+	if ps.started {
+		return
+	}
+	if ps.format == streamSSE {
+		ps.w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		ps.w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	ps.w.Header().Set("Cache-Control", "no-cache")
+	ps.started = true
+}
+
+func (ps *pageStreamer) writeEvent(event string, blob []byte) error {
+	ps.writeHeaders()
+
+	var err error
+	if ps.format == streamSSE {
+		_, err = fmt.Fprintf(ps.w, "event: %s\ndata: %s\n\n", event, blob)
+	} else {
+		_, err = fmt.Fprintf(ps.w, "%s\n", blob)
+	}
+	if flusher, ok := ps.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return err
+}
+
+func (ps *pageStreamer) writePage(page *youtube.SearchPage) error {
+	blob, err := json.Marshal(page)
+	if err != nil {
+		return err
+	}
+	ps.pages++
+	return ps.writeEvent("page", blob)
+}
+
+// writeAll streams the pages of already marshaled results.
+func (ps *pageStreamer) writeAll(resultsBlob []byte) error {
+	var pages []json.RawMessage
+	if err := json.Unmarshal(resultsBlob, &pages); err != nil {
+		return err
+	}
+	for _, page := range pages {
+		ps.pages++
+		if err := ps.writeEvent("page", page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ps *pageStreamer) writeError(err error) error {
+	blob, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return ps.writeEvent("error", blob)
+}
+
+// finish ends the stream with the continuation token, if any, for the
+// page after the streamed ones and the suggestions, if any, for a query
+// that found nothing. SSE streams always end with a "done" event whereas
+// NDJSON streams end with a final line of {"continuation": token,
+// "suggestions": [...]} only if there is a token or suggestions.
+func (ps *pageStreamer) finish(continuation string, suggestions []string) error {
+	if ps.format != streamSSE {
+		ps.writeHeaders()
+		if continuation == "" && len(suggestions) == 0 {
+			return nil
+		}
+		blob, _ := json.Marshal(struct {
+			Continuation string   `json:"continuation,omitempty"`
+			Suggestions  []string `json:"suggestions,omitempty"`
+		}{continuation, suggestions})
+		return ps.writeEvent("done", blob)
+	}
+	blob, _ := json.Marshal(map[string]interface{}{
+		"pages":        ps.pages,
+		"continuation": continuation,
+		"suggestions":  suggestions,
+	})
+	return ps.writeEvent("done", blob)
+}
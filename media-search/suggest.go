@@ -0,0 +1,260 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/trace"
+)
+
+const (
+	// maxSuggestions is the most "did you mean" alternatives offered.
+	maxSuggestions = 3
+	// suggestionVocabulary is how many of the queries that most
+	// often found results the suggestions are chosen from.
+	suggestionVocabulary = 5000
+)
+
+// querySuggester suggests alternatives to queries that found nothing.
+var querySuggester = new(suggester)
+
+// suggester suggests queries, from the history of those that
+// found results, that are spelled like a query that didn't.
+type suggester struct {
+	mu sync.RWMutex
+	// queries are ordered from the most to the least successful.
+	queries []*queryStats
+	// words maps each word of queries to how often it found results.
+	words map[string]int64
+}
+
+// refreshEvery reloads the suggestions from the history each interval,
+// in a trace of its own since it isn't part of any request.
+func (s *suggester) refreshEvery(interval time.Duration) {
+	for {
+		ctx, span := trace.StartSpan(context.Background(), "/refresh-suggestions")
+		if err := s.refresh(ctx); err != nil {
+			span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+		}
+		span.End()
+		time.Sleep(interval)
+	}
+}
+
+func (s *suggester) refresh(ctx context.Context) error {
+	pipeline := bson.NewArray(
+		bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("$match",
+			bson.EC.SubDocumentFromElements("successes", bson.EC.Int64("$gt", 0)),
+		)),
+		bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("$sort", bson.EC.Int32("successes", -1))),
+		bson.VC.DocumentFromElements(bson.EC.Int32("$limit", suggestionVocabulary)),
+	)
+	var queries []*queryStats
+	words := make(map[string]int64)
+	err := aggregate(ctx, queryStatsCollection, pipeline, func(cur mongo.Cursor) error {
+		qs := new(queryStats)
+		if err := cur.Decode(qs); err != nil {
+			return err
+		}
+		queries = append(queries, qs)
+		for _, word := range strings.Fields(qs.Query) {
+			words[word] += qs.Successes
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	trace.FromContext(ctx).AddAttributes(trace.Int64Attribute("queries", int64(len(queries))))
+
+	s.mu.Lock()
+	s.queries, s.words = queries, words
+	s.mu.Unlock()
+	return nil
+}
+
+type candidate struct {
+	query     string
+	distance  int
+	successes int64
+}
+
+// suggest returns up to maxSuggestions queries like normalized, the
+// closest first and, among equally close ones, the most successful.
+// They are past queries a few edits away from normalized, and
+// normalized with each unknown word replaced by the closest known one.
+func (s *suggester) suggest(ctx context.Context, normalized string) []string {
+	_, span := trace.StartSpan(ctx, "/suggest")
+	defer span.End()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	candidates := make(map[string]*candidate)
+	for _, qs := range s.queries {
+		d := editDistance(normalized, qs.Query)
+		if d > 0 && d <= maxEdits(normalized) {
+			candidates[qs.Query] = &candidate{query: qs.Query, distance: d, successes: qs.Successes}
+		}
+	}
+
+	words := strings.Fields(normalized)
+	corrected, total := make([]string, len(words)), 0
+	for i, word := range words {
+		corrected[i] = word
+		if _, known := s.words[word]; known {
+			continue
+		}
+		best, bestD, bestN := "", maxEdits(word)+1, int64(0)
+		for known, n := range s.words {
+			if d := editDistance(word, known); d < bestD || (d == bestD && n > bestN) {
+				best, bestD, bestN = known, d, n
+			}
+		}
+		if best != "" {
+			corrected[i] = best
+			total += bestD
+		}
+	}
+	if total > 0 {
+		q := strings.Join(corrected, " ")
+		if _, ok := candidates[q]; !ok {
+			candidates[q] = &candidate{query: q, distance: total}
+		}
+	}
+
+	ranked := make([]*candidate, 0, len(candidates))
+	for _, c := range candidates {
+		ranked = append(ranked, c)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		ci, cj := ranked[i], ranked[j]
+		if ci.distance != cj.distance {
+			return ci.distance < cj.distance
+		}
+		if ci.successes != cj.successes {
+			return ci.successes > cj.successes
+		}
+		return ci.query < cj.query
+	})
+	suggestions := make([]string, 0, maxSuggestions)
+	for _, c := range ranked {
+		if len(suggestions) == maxSuggestions {
+			break
+		}
+		suggestions = append(suggestions, c.query)
+	}
+
+	span.AddAttributes(trace.Int64Attribute("suggestions", int64(len(suggestions))))
+	stats.Record(ctx, suggestionsOffered.M(int64(len(suggestions))))
+	return suggestions
+}
+
+// suggestFor returns suggestions for q if it found nothing. Pages
+// after the first aren't offered suggestions since the first page
+// was found.
+func suggestFor(ctx context.Context, q *query, items int64) []string {
+	if items > 0 || q.pageToken != "" {
+		return nil
+	}
+	return querySuggester.suggest(ctx, normalizeKeywords(q.Keywords))
+}
+
+// suggestionsHeader encodes suggestions as a JSON array for the
+// X-Suggestions header, escaping non-ASCII characters since
+// header values are meant to be ASCII.
+func suggestionsHeader(suggestions []string) string {
+	blob, _ := json.Marshal(suggestions)
+	var buf bytes.Buffer
+	for _, r := range string(blob) {
+		switch {
+		case r < utf8.RuneSelf:
+			buf.WriteRune(r)
+		case r > 0xFFFF:
+			r1, r2 := utf16.EncodeRune(r)
+			fmt.Fprintf(&buf, `\u%04x\u%04x`, r1, r2)
+		default:
+			fmt.Fprintf(&buf, `\u%04x`, r)
+		}
+	}
+	return buf.String()
+}
+
+// maxEdits is how many edits away from s a suggestion may be.
+func maxEdits(s string) int {
+	switch n := len([]rune(s)); {
+	case n <= 4:
+		return 1
+	case n <= 8:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// editDistance returns the optimal string alignment distance between a
+// and b: the fewest insertions, deletions, substitutions and transpositions
+// of adjacent runes that turn one into the other.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	// prev2, prev and cur are the last three rows of the distance matrix.
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] && prev2[j-2]+1 < cur[j] {
+				cur[j] = prev2[j-2] + 1
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+var suggestionsOffered = stats.Int64("suggestions_offered", "the number of did you mean suggestions offered for queries that found nothing", stats.UnitNone)
@@ -0,0 +1,371 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+// thumbQualities maps the qualities that /thumb accepts to the
+// names of YouTube's thumbnail files. The names of the sizes in
+// search results e.g. "medium" are accepted as aliases.
+var thumbQualities = map[string]string{
+	"default":       "default",
+	"mqdefault":     "mqdefault",
+	"hqdefault":     "hqdefault",
+	"sddefault":     "sddefault",
+	"maxresdefault": "maxresdefault",
+	"medium":        "mqdefault",
+	"high":          "hqdefault",
+	"standard":      "sddefault",
+	"maxres":        "maxresdefault",
+}
+
+const (
+	thumbMinWidth = 16
+	thumbMaxWidth = 1280
+	// thumbMaxAge is how long clients may cache thumbnails
+	// for, since YouTube rarely changes a video's thumbnails.
+	thumbMaxAge = 24 * time.Hour
+	// thumbMaxBytes bounds the thumbnails fetched from YouTube.
+	thumbMaxBytes = 4 << 20
+)
+
+var videoIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+
+var thumbs *thumbCache
+
+// thumbClient fetches thumbnails from YouTube's CDN, tracing each fetch.
+var thumbClient = &http.Client{
+	Transport: &ochttp.Transport{},
+	Timeout:   10 * time.Second,
+}
+
+var thumbCacheKey tag.Key
+
+var (
+	errThumbNotFound = errors.New("no such thumbnail")
+	errThumbTooLarge = fmt.Errorf("the thumbnail is larger than %d bytes", thumbMaxBytes)
+)
+
+// thumb serves /thumb/{videoId}/{quality}, optionally resized to the
+// "w" parameter's width, from the on-disk cache or else from YouTube.
+func thumb(w http.ResponseWriter, r *http.Request) {
+	ctx, span := trace.StartSpan(r.Context(), "/thumb")
+	defer span.End()
+
+	splits := strings.Split(strings.TrimPrefix(r.URL.Path, "/thumb/"), "/")
+	if len(splits) != 2 || !videoIDRe.MatchString(splits[0]) {
+		writeJSONError(w, http.StatusNotFound, errThumbNotFound)
+		return
+	}
+	videoID := splits[0]
+	quality, ok := thumbQualities[splits[1]]
+	if !ok {
+		errs := []*fieldError{{Field: "quality", Message: "must be one of default, medium, high, standard or maxres"}}
+		recordValidationFailures(ctx, errs)
+		writeJSONError(w, http.StatusBadRequest, &validationError{Fields: errs})
+		return
+	}
+	width := 0
+	if str := r.URL.Query().Get("w"); str != "" {
+		var err error
+		width, err = strconv.Atoi(str)
+		if err != nil || width < thumbMinWidth || width > thumbMaxWidth {
+			errs := []*fieldError{{Field: "w", Message: fmt.Sprintf("must be a width from %d to %d", thumbMinWidth, thumbMaxWidth)}}
+			recordValidationFailures(ctx, errs)
+			writeJSONError(w, http.StatusBadRequest, &validationError{Fields: errs})
+			return
+		}
+	}
+	span.AddAttributes(
+		trace.StringAttribute("video_id", videoID),
+		trace.StringAttribute("quality", quality),
+		trace.Int64Attribute("width", int64(width)),
+	)
+
+	name := videoID + "_" + quality
+	if width > 0 {
+		name += "_w" + strconv.Itoa(width)
+	}
+	name += ".jpg"
+
+	data, modTime, hit := thumbs.get(name)
+	if hit {
+		span.Annotate([]trace.Attribute{trace.BoolAttribute("hit", true)}, "Thumbnail cache hit")
+	} else {
+		span.Annotate([]trace.Attribute{trace.BoolAttribute("hit", false)}, "Thumbnail cache miss")
+		var err error
+		data, err = fetchThumb(r, videoID, quality, width)
+		switch err {
+		case nil:
+		case errThumbNotFound:
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		default:
+			span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+			writeJSONError(w, http.StatusBadGateway, err)
+			return
+		}
+		modTime = time.Now()
+		if err := thumbs.put(name, data); err != nil {
+			span.Annotate([]trace.Attribute{trace.StringAttribute("error", err.Error())}, "Failed to cache the thumbnail")
+		}
+	}
+
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	ctx, _ = tag.New(ctx, tag.Upsert(thumbCacheKey, result))
+	stats.Record(ctx, thumbRequests.M(1), thumbBytesServed.M(int64(len(data))))
+
+	sum := sha256.Sum256(data)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(thumbMaxAge/time.Second)))
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, name, modTime, bytes.NewReader(data))
+}
+
+// fetchThumb fetches a thumbnail from YouTube's CDN, through the
+// cache if it is to be resized so that other widths can reuse it.
+func fetchThumb(r *http.Request, videoID, quality string, width int) ([]byte, error) {
+	ctx := r.Context()
+	if width > 0 {
+		original := videoID + "_" + quality + ".jpg"
+		data, _, ok := thumbs.get(original)
+		if !ok {
+			var err error
+			if data, err = fetchThumb(r, videoID, quality, 0); err != nil {
+				return nil, err
+			}
+			_ = thumbs.put(original, data)
+		}
+		return resizeThumb(r, data, width)
+	}
+
+	url := "https://i.ytimg.com/vi/" + videoID + "/" + quality + ".jpg"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := thumbClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil, errThumbNotFound
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("fetching the thumbnail: %s", res.Status)
+	}
+	// Read a byte past the limit to tell a thumbnail that is too
+	// large from one that is exactly as large as allowed.
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, thumbMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > thumbMaxBytes {
+		return nil, errThumbTooLarge
+	}
+	return data, nil
+}
+
+func resizeThumb(r *http.Request, data []byte, width int) ([]byte, error) {
+	_, span := trace.StartSpan(r.Context(), "/thumb-resize")
+	defer span.End()
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+		return nil, err
+	}
+	bounds := src.Bounds()
+	// Thumbnails are only ever scaled down.
+	if width >= bounds.Dx() {
+		return data, nil
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, dst, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	span.AddAttributes(
+		trace.Int64Attribute("width", int64(width)),
+		trace.Int64Attribute("height", int64(height)),
+		trace.Int64Attribute("bytes", int64(buf.Len())),
+	)
+	return buf.Bytes(), nil
+}
+
+// thumbCache is an on-disk cache of thumbnails that removes the least
+// recently used ones once they take up more than maxBytes in total.
+type thumbCache struct {
+	dir      string
+	maxBytes int64
+
+	mu   sync.Mutex
+	size int64
+	// ll is ordered from the most to the least recently used
+	// thumbnail and each of its elements holds a *thumbEntry.
+	ll      *list.List
+	entries map[string]*list.Element
+}
+
+type thumbEntry struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// newThumbCache returns a cache in dir, which holds
+// on to the thumbnails cached in it by earlier runs.
+func newThumbCache(dir string, maxBytes int64) (*thumbCache, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("the thumbnail cache size must be positive, got %d", maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().After(infos[j].ModTime()) })
+
+	tc := &thumbCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	for _, info := range infos {
+		if info.IsDir() || filepath.Ext(info.Name()) != ".jpg" {
+			continue
+		}
+		tc.entries[info.Name()] = tc.ll.PushBack(&thumbEntry{name: info.Name(), size: info.Size(), modTime: info.ModTime()})
+		tc.size += info.Size()
+	}
+	tc.mu.Lock()
+	tc.evictLocked()
+	tc.mu.Unlock()
+	return tc, nil
+}
+
+func (tc *thumbCache) get(name string) ([]byte, time.Time, bool) {
+	tc.mu.Lock()
+	elem, ok := tc.entries[name]
+	if ok {
+		tc.ll.MoveToFront(elem)
+	}
+	tc.mu.Unlock()
+	if !ok {
+		return nil, time.Time{}, false
+	}
+
+	entry := elem.Value.(*thumbEntry)
+	data, err := ioutil.ReadFile(filepath.Join(tc.dir, name))
+	if err != nil {
+		// It was evicted meanwhile or removed behind our back.
+		return nil, time.Time{}, false
+	}
+	return data, entry.modTime, true
+}
+
+func (tc *thumbCache) put(name string, data []byte) (err error) {
+	// Write to a temporary file first so that readers
+	// never see a partially written thumbnail.
+	tmp, err := ioutil.TempFile(tc.dir, name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), filepath.Join(tc.dir, name)); err != nil {
+		return err
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	entry := &thumbEntry{name: name, size: int64(len(data)), modTime: time.Now()}
+	if elem, ok := tc.entries[name]; ok {
+		tc.size -= elem.Value.(*thumbEntry).size
+		elem.Value = entry
+		tc.ll.MoveToFront(elem)
+	} else {
+		tc.entries[name] = tc.ll.PushFront(entry)
+	}
+	tc.size += entry.size
+	tc.evictLocked()
+	return nil
+}
+
+// evictLocked must be invoked with tc.mu held.
+func (tc *thumbCache) evictLocked() {
+	for tc.size > tc.maxBytes && tc.ll.Len() > 0 {
+		elem := tc.ll.Back()
+		entry := elem.Value.(*thumbEntry)
+		tc.ll.Remove(elem)
+		delete(tc.entries, entry.name)
+		tc.size -= entry.size
+		_ = os.Remove(filepath.Join(tc.dir, entry.name))
+	}
+}
+
+var (
+	thumbRequests    = stats.Int64("thumb_requests", "the number of thumbnails served", stats.UnitNone)
+	thumbBytesServed = stats.Int64("thumb_bytes_served", "the bytes of thumbnails served", stats.UnitBytes)
+)
@@ -0,0 +1,91 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// continuation is the payload of a continuation token. It holds
+// everything needed to fetch the page after a response's last page.
+type continuation struct {
+	Query     *query `json:"query"`
+	PageToken string `json:"page_token"`
+}
+
+var errInvalidContinuation = errors.New("invalid continuation token")
+
+// tokenSigner signs continuation tokens with HMAC-SHA256 so that
+// clients can't forge them to make arbitrary upstream requests.
+type tokenSigner struct {
+	secret []byte
+}
+
+// newTokenSigner returns a signer using secret or, if it is empty,
+// a random secret, in which case tokens don't survive restarts.
+func newTokenSigner(secret string) (*tokenSigner, error) {
+	if secret != "" {
+		return &tokenSigner{secret: []byte(secret)}, nil
+	}
+	randSecret := make([]byte, 32)
+	if _, err := rand.Read(randSecret); err != nil {
+		return nil, err
+	}
+	return &tokenSigner{secret: randSecret}, nil
+}
+
+func (ts *tokenSigner) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, ts.secret)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// encode returns the opaque token for c, of the form "<payload>.<signature>".
+func (ts *tokenSigner) encode(c *continuation) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(ts.mac(payload)), nil
+}
+
+func (ts *tokenSigner) decode(token string) (*continuation, error) {
+	splits := strings.SplitN(token, ".", 2)
+	if len(splits) != 2 {
+		return nil, errInvalidContinuation
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(splits[0])
+	if err != nil {
+		return nil, errInvalidContinuation
+	}
+	sig, err := enc.DecodeString(splits[1])
+	if err != nil || !hmac.Equal(sig, ts.mac(payload)) {
+		return nil, errInvalidContinuation
+	}
+
+	c := new(continuation)
+	if err := json.Unmarshal(payload, c); err != nil || c.Query == nil || c.PageToken == "" {
+		return nil, errInvalidContinuation
+	}
+	return c, nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+
+	"github.com/orijtech/youtube"
+)
+
+// videosCollection holds the metadata of every video
+// that has been found by a search, one document each.
+var videosCollection *mongo.Collection
+
+type video struct {
+	ID           string            `json:"id" bson:"_id"`
+	Title        string            `json:"title" bson:"title"`
+	Description  string            `json:"description,omitempty" bson:"description,omitempty"`
+	ChannelID    string            `json:"channel_id,omitempty" bson:"channel_id,omitempty"`
+	ChannelTitle string            `json:"channel_title,omitempty" bson:"channel_title,omitempty"`
+	PublishedAt  string            `json:"published_at,omitempty" bson:"published_at,omitempty"`
+	Thumbnails   map[string]string `json:"thumbnails,omitempty" bson:"thumbnails,omitempty"`
+	FirstSeen    time.Time         `json:"first_seen" bson:"first_seen"`
+	LastSeen     time.Time         `json:"last_seen" bson:"last_seen"`
+}
+
+func setupVideos(db *mongo.Database) {
+	videosCollection = db.Collection("videos")
+
+	_, err := videosCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.NewDocument(bson.EC.Int32("channel_id", 1)),
+		Options: bson.NewDocument(bson.EC.String("name", "channel_id")),
+	})
+	if err != nil {
+		log.Printf("Failed to create the videos index: %v", err)
+	}
+}
+
+// recordVideos stores the metadata of the videos in pages. Like
+// recordSearch, it runs in the background in a span linked to ctx's.
+func recordVideos(ctx context.Context, pages []*youtube.SearchPage) {
+	if videosCollection == nil {
+		return
+	}
+	parentSC := trace.FromContext(ctx).SpanContext()
+	bgCtx := tag.NewContext(context.Background(), tag.FromContext(ctx))
+	go func() {
+		ctx, span := trace.StartSpan(bgCtx, "/record-videos")
+		defer span.End()
+		span.AddLink(trace.Link{
+			TraceID: parentSC.TraceID,
+			SpanID:  parentSC.SpanID,
+			Type:    trace.LinkTypeParent,
+		})
+
+		videos := videosIn(pages, time.Now())
+		span.AddAttributes(trace.Int64Attribute("videos", int64(len(videos))))
+		if len(videos) == 0 {
+			return
+		}
+		if err := storeVideos(ctx, videos); err != nil {
+			stats.Record(ctx, mongoErrors.M(1))
+			span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+		}
+	}()
+}
+
+// videosIn returns the distinct videos in pages as first seen at now.
+func videosIn(pages []*youtube.SearchPage, now time.Time) []*video {
+	var videos []*video
+	seen := make(map[string]bool)
+	for _, page := range pages {
+		if page == nil {
+			continue
+		}
+		for _, item := range page.Items {
+			if item == nil {
+				continue
+			}
+			cr := newCachedResult(item)
+			if cr.VideoID == "" || seen[cr.VideoID] {
+				continue
+			}
+			seen[cr.VideoID] = true
+			videos = append(videos, &video{
+				ID:           cr.VideoID,
+				Title:        cr.Title,
+				Description:  cr.Description,
+				ChannelID:    cr.ChannelID,
+				ChannelTitle: cr.ChannelTitle,
+				PublishedAt:  cr.PublishedAt,
+				Thumbnails:   cr.thumbnailURLs(),
+				FirstSeen:    now,
+				LastSeen:     now,
+			})
+		}
+	}
+	return videos
+}
+
+// storeVideos inserts or updates videos in a fixed number of round
+// trips however many there are: one to find those stored already, one
+// to insert the rest and one to update when they were all last seen.
+// Only stored videos whose metadata has changed, which is rare, are
+// updated one by one.
+func storeVideos(ctx context.Context, videos []*video) error {
+	ids := make([]string, 0, len(videos))
+	for _, v := range videos {
+		ids = append(ids, v.ID)
+	}
+	byIDs := bson.NewDocument(bson.EC.SubDocumentFromElements("_id", bson.EC.Array("$in", stringArray(ids))))
+
+	stored := make(map[string]*video)
+	pipeline := bson.NewArray(bson.VC.DocumentFromElements(bson.EC.SubDocument("$match", byIDs)))
+	if err := aggregate(ctx, videosCollection, pipeline, func(cur mongo.Cursor) error {
+		v := new(video)
+		if err := cur.Decode(v); err != nil {
+			return err
+		}
+		stored[v.ID] = v
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var fresh []*video
+	for _, v := range videos {
+		sv, ok := stored[v.ID]
+		switch {
+		case !ok:
+			fresh = append(fresh, v)
+		case !v.sameMetadata(sv):
+			if _, err := videosCollection.UpdateOne(ctx, v.idFilter(), v.update()); err != nil {
+				return err
+			}
+		}
+	}
+	if err := insertVideos(ctx, fresh); err != nil {
+		return err
+	}
+
+	_, err := videosCollection.UpdateMany(ctx, byIDs, bson.NewDocument(
+		bson.EC.SubDocumentFromElements("$set", bson.EC.Time("last_seen", videos[0].LastSeen)),
+	))
+	return err
+}
+
+// insertVideos inserts videos, which weren't stored, in one go.
+func insertVideos(ctx context.Context, videos []*video) error {
+	if len(videos) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, 0, len(videos))
+	for _, v := range videos {
+		docs = append(docs, v)
+	}
+	_, err := videosCollection.InsertMany(ctx, docs)
+	if !isDuplicateKeyError(err) {
+		return err
+	}
+	// A concurrent search inserted some of them first, and the
+	// insert stopped there, so fall back to upserting each of them.
+	for _, v := range videos {
+		if err := upsert(ctx, videosCollection, v.idFilter(), v.update(), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *video) idFilter() *bson.Document {
+	return bson.NewDocument(bson.EC.String("_id", v.ID))
+}
+
+// update sets v's metadata and when it was last seen.
+func (v *video) update() *bson.Document {
+	thumbnails := bson.NewDocument()
+	for size, url := range v.Thumbnails {
+		thumbnails.Append(bson.EC.String(size, url))
+	}
+	return bson.NewDocument(bson.EC.SubDocumentFromElements("$set",
+		bson.EC.String("title", v.Title),
+		bson.EC.String("description", v.Description),
+		bson.EC.String("channel_id", v.ChannelID),
+		bson.EC.String("channel_title", v.ChannelTitle),
+		bson.EC.String("published_at", v.PublishedAt),
+		bson.EC.SubDocument("thumbnails", thumbnails),
+		bson.EC.Time("last_seen", v.LastSeen),
+	))
+}
+
+// sameMetadata reports whether v and other describe the video alike.
+func (v *video) sameMetadata(other *video) bool {
+	return v.Title == other.Title &&
+		v.Description == other.Description &&
+		v.ChannelID == other.ChannelID &&
+		v.ChannelTitle == other.ChannelTitle &&
+		v.PublishedAt == other.PublishedAt &&
+		sameThumbnails(v.Thumbnails, other.Thumbnails)
+}
+
+func sameThumbnails(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for size, url := range a {
+		if b[size] != url {
+			return false
+		}
+	}
+	return true
+}
+
+// videoByID serves /videos/{id} with the stored metadata of the video.
+func videoByID(w http.ResponseWriter, r *http.Request) {
+	ctx, span := trace.StartSpan(r.Context(), "/videos")
+	defer span.End()
+
+	id := strings.TrimPrefix(r.URL.Path, "/videos/")
+	span.AddAttributes(trace.StringAttribute("id", id))
+	if id == "" || strings.Contains(id, "/") {
+		writeJSONError(w, http.StatusNotFound, errors.New("no such video"))
+		return
+	}
+
+	v := new(video)
+	switch err := videosCollection.FindOne(ctx, bson.NewDocument(bson.EC.String("_id", id))).Decode(v); err {
+	case nil:
+		writeJSON(w, v)
+	case bson.ErrElementNotFound, mongo.ErrNoDocuments:
+		writeJSONError(w, http.StatusNotFound, errors.New("no such video"))
+	default:
+		stats.Record(ctx, mongoErrors.M(1))
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+		writeJSONError(w, http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright 2018, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build ignore
+
+// The load generator drives traffic against the reservations
+// server so that its views have realistic data to show. Run it with:
+//
+//	go run loadgen.go defs.pb.go --addr localhost:9449 --qps 50 --duration 1m
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	ts "go.opencensus.io/exporter/trace/stackdriver"
+	ocgrpc "go.opencensus.io/plugin/grpc"
+	"go.opencensus.io/trace"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	opCreate = "create"
+	opFind   = "find"
+	opDelete = "delete"
+)
+
+func main() {
+	var projectID, addr, mixSpec string
+	var qps, zipfS, sampleRate float64
+	var concurrency, venueCount int
+	var duration time.Duration
+	flag.StringVar(&projectID, "project-id", "census-demo", "the GCP project-id to export traces to")
+	flag.StringVar(&addr, "addr", "localhost:9449", "the address of the reservations server")
+	flag.StringVar(&mixSpec, "mix", "create=2,find=6,delete=1", "the relative weights of create, find and delete calls")
+	flag.Float64Var(&qps, "qps", 20, "the target number of calls per second, 0 for as fast as possible")
+	flag.Float64Var(&zipfS, "zipf-s", 1.2, "the Zipf exponent, greater than 1, for picking venues")
+	flag.Float64Var(&sampleRate, "sample-rate", 0.1, "the fraction of calls whose traces are sampled")
+	flag.IntVar(&concurrency, "concurrency", 8, "the number of concurrent callers")
+	flag.IntVar(&venueCount, "venues", 100, "the number of distinct venues")
+	flag.DurationVar(&duration, "duration", 30*time.Second, "how long to generate load for")
+	flag.Parse()
+
+	mix, err := parseMix(mixSpec)
+	if err != nil {
+		log.Fatalf("Parsing --mix: %v", err)
+	}
+	if zipfS <= 1 {
+		log.Fatalf("--zipf-s must be greater than 1, got %v", zipfS)
+	}
+	if concurrency <= 0 || venueCount <= 0 {
+		log.Fatalf("--concurrency and --venues must be positive")
+	}
+	// The calls are paced by a ticker every second/qps, which must be at
+	// least 1ns and, for any call to be made at all, at most duration.
+	if qps != 0 && !(qps > 0 && qps <= 1e9 && float64(time.Second)/qps <= float64(duration)) {
+		log.Fatalf("--qps must be 0 or from %v to 1e9, got %v", 1/duration.Seconds(), qps)
+	}
+
+	ste, err := ts.NewExporter(ts.Options{
+		ProjectID: projectID,
+	})
+	if err != nil {
+		log.Fatalf("trace/StackDriver err: %v", err)
+	}
+	trace.RegisterExporter(ste)
+	trace.SetDefaultSampler(trace.ProbabilitySampler(sampleRate))
+	defer trace.UnregisterExporter(ste)
+	defer ste.Flush()
+
+	// The client stats handler propagates the trace context
+	// of every call so that the server's spans join ours.
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithStatsHandler(ocgrpc.NewClientStatsHandler()))
+	if err != nil {
+		log.Fatalf("Dialing %q: %v", addr, err)
+	}
+	defer conn.Close()
+
+	lg := &loadGen{
+		client:  NewAppClient(conn),
+		mix:     mix,
+		venues:  venueCount,
+		zipfS:   zipfS,
+		codes:   make(map[string][]string),
+		results: make(map[string]*opResults),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	log.Printf("Generating load against %q for %s at %v QPS with %d callers", addr, duration, qps, concurrency)
+	lg.run(ctx, qps, concurrency)
+	lg.printSummary(os.Stdout)
+}
+
+type weightedOp struct {
+	name   string
+	weight int
+}
+
+func parseMix(spec string) ([]weightedOp, error) {
+	var mix []weightedOp
+	for _, field := range strings.Split(spec, ",") {
+		splits := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(splits) != 2 {
+			return nil, fmt.Errorf("%q is not of the form op=weight", field)
+		}
+		switch splits[0] {
+		case opCreate, opFind, opDelete:
+		default:
+			return nil, fmt.Errorf("unknown op %q", splits[0])
+		}
+		weight, err := strconv.Atoi(splits[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight %q for %q", splits[1], splits[0])
+		}
+		if weight > 0 {
+			mix = append(mix, weightedOp{name: splits[0], weight: weight})
+		}
+	}
+	if len(mix) == 0 {
+		return nil, fmt.Errorf("no ops with a positive weight")
+	}
+	return mix, nil
+}
+
+type opResults struct {
+	latencies []time.Duration
+	errors    map[string]int
+	skipped   int
+	slowest   []sampledCall
+}
+
+// sampledCall records a traced call so that it can
+// be looked up by its trace ID in the backend.
+type sampledCall struct {
+	latency time.Duration
+	traceID string
+}
+
+const maxSlowestPerOp = 3
+
+type loadGen struct {
+	client AppClient
+	mix    []weightedOp
+	venues int
+	zipfS  float64
+
+	mu sync.Mutex
+	// codes holds the reservation codes created so far, by venue.
+	codes   map[string][]string
+	results map[string]*opResults
+}
+
+func (lg *loadGen) run(ctx context.Context, qps float64, concurrency int) {
+	ticketsChan := make(chan struct{})
+	go func() {
+		defer close(ticketsChan)
+		var tickChan <-chan time.Time
+		if qps > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / qps))
+			defer ticker.Stop()
+			tickChan = ticker.C
+		}
+		for {
+			if tickChan != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-tickChan:
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case ticketsChan <- struct{}{}:
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			zipf := rand.NewZipf(rng, lg.zipfS, 1, uint64(lg.venues-1))
+			for range ticketsChan {
+				lg.doOne(ctx, rng, zipf)
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+}
+
+func (lg *loadGen) pickOp(rng *rand.Rand) string {
+	total := 0
+	for _, wop := range lg.mix {
+		total += wop.weight
+	}
+	n := rng.Intn(total)
+	for _, wop := range lg.mix {
+		if n < wop.weight {
+			return wop.name
+		}
+		n -= wop.weight
+	}
+	return lg.mix[len(lg.mix)-1].name
+}
+
+func (lg *loadGen) doOne(ctx context.Context, rng *rand.Rand, zipf *rand.Zipf) {
+	op := lg.pickOp(rng)
+	venue := fmt.Sprintf("venue-%d", zipf.Uint64())
+	email := fmt.Sprintf("user-%d@example.org", rng.Intn(1000))
+
+	ctx = trace.StartSpan(ctx, "/loadgen/"+op)
+	defer trace.EndSpan(ctx)
+
+	var err error
+	startTime := time.Now()
+	switch op {
+	case opCreate:
+		var rsv *Reservation
+		rsv, err = lg.client.Create(ctx, &Reservation{
+			Email: email,
+			Venue: venue,
+			Time:  float64(time.Now().Add(time.Duration(rng.Intn(72)) * time.Hour).Unix()),
+		})
+		if err == nil && rsv != nil && rsv.Code != "" {
+			lg.addCode(venue, rsv.Code)
+		}
+
+	case opFind:
+		if code, ok := lg.pickCode(venue, rng, false); ok {
+			_, err = lg.client.FindByCode(ctx, &Reservation{Code: code})
+		} else {
+			_, err = lg.client.FindByEmail(ctx, &Reservation{Email: email})
+		}
+
+	case opDelete:
+		code, ok := lg.pickCode(venue, rng, true)
+		if !ok {
+			lg.recordSkip(op)
+			return
+		}
+		_, err = lg.client.Delete(ctx, &Reservation{Code: code})
+	}
+
+	// Calls cut short by the end of the run aren't meaningful.
+	if ctx.Err() != nil {
+		return
+	}
+	lg.record(ctx, op, time.Since(startTime), err)
+}
+
+func (lg *loadGen) addCode(venue, code string) {
+	lg.mu.Lock()
+	lg.codes[venue] = append(lg.codes[venue], code)
+	lg.mu.Unlock()
+}
+
+// pickCode returns a random code previously created for venue,
+// removing it from the pool if remove is set.
+func (lg *loadGen) pickCode(venue string, rng *rand.Rand, remove bool) (string, bool) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	codes := lg.codes[venue]
+	if len(codes) == 0 {
+		return "", false
+	}
+	i := rng.Intn(len(codes))
+	code := codes[i]
+	if remove {
+		codes[i] = codes[len(codes)-1]
+		lg.codes[venue] = codes[:len(codes)-1]
+	}
+	return code, true
+}
+
+func (lg *loadGen) resultsFor(op string) *opResults {
+	res := lg.results[op]
+	if res == nil {
+		res = &opResults{errors: make(map[string]int)}
+		lg.results[op] = res
+	}
+	return res
+}
+
+func (lg *loadGen) recordSkip(op string) {
+	lg.mu.Lock()
+	lg.resultsFor(op).skipped++
+	lg.mu.Unlock()
+}
+
+func (lg *loadGen) record(ctx context.Context, op string, latency time.Duration, err error) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	res := lg.resultsFor(op)
+	res.latencies = append(res.latencies, latency)
+	if err != nil {
+		res.errors[status.Code(err).String()]++
+	}
+
+	sc := trace.FromContext(ctx).SpanContext()
+	if !sc.IsSampled() {
+		return
+	}
+	res.slowest = append(res.slowest, sampledCall{latency: latency, traceID: sc.TraceID.String()})
+	sort.Slice(res.slowest, func(i, j int) bool { return res.slowest[i].latency > res.slowest[j].latency })
+	if len(res.slowest) > maxSlowestPerOp {
+		res.slowest = res.slowest[:maxSlowestPerOp]
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p/100*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func (lg *loadGen) printSummary(w io.Writer) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "op\tcalls\terrors\tskipped\tp50\tp90\tp95\tp99\tmax")
+	for _, op := range []string{opCreate, opFind, opDelete} {
+		res := lg.results[op]
+		if res == nil {
+			continue
+		}
+		sorted := append([]time.Duration(nil), res.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		nErrs := 0
+		for _, n := range res.errors {
+			nErrs += n
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			op, len(sorted), nErrs, res.skipped,
+			percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 95),
+			percentile(sorted, 99), percentile(sorted, 100))
+	}
+	tw.Flush()
+
+	for _, op := range []string{opCreate, opFind, opDelete} {
+		res := lg.results[op]
+		if res == nil {
+			continue
+		}
+		for code, n := range res.errors {
+			fmt.Fprintf(w, "%s errors: %s: %d\n", op, code, n)
+		}
+		for _, call := range res.slowest {
+			fmt.Fprintf(w, "%s slowest sampled: %s traceID: %s\n", op, call.latency, call.traceID)
+		}
+	}
+}
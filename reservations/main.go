@@ -18,26 +18,40 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"os/signal"
 	"reflect"
 	"strings"
+	"syscall"
+	"time"
 	"unicode"
 
 	"cloud.google.com/go/spanner"
 	"github.com/google/uuid"
 	ss "go.opencensus.io/exporter/stats/stackdriver"
 	ts "go.opencensus.io/exporter/trace/stackdriver"
+	ocgrpc "go.opencensus.io/plugin/grpc"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
 	"go.opencensus.io/trace"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
 var sc *spanner.Client
 
 func main() {
-	var projectID string
+	var projectID, addr string
+	var drainTimeout, healthInterval time.Duration
 	flag.StringVar(&projectID, "project-id", "census-demo", "the Spanner and GCP project-id")
+	flag.StringVar(&addr, "addr", ":9449", "the address on which to serve the gRPC App service")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 15*time.Second, "how long to wait for in-flight RPCs to finish on shutdown")
+	flag.DurationVar(&healthInterval, "health-interval", 10*time.Second, "how often to ping Spanner to update the health status")
 	flag.Parse()
 
 	ctx := context.Background()
@@ -46,6 +60,7 @@ func main() {
 		log.Fatalf("Creating New Spanner client: err: %v", err)
 	}
 	sc = client
+	defer sc.Close()
 
 	sse, err := ss.NewExporter(ss.Options{
 		ProjectID: projectID,
@@ -61,9 +76,149 @@ func main() {
 	}
 	trace.RegisterExporter(ste)
 	stats.RegisterExporter(sse)
+	setupViews()
 
-	defer trace.UnregisterExporter(ste)
-	defer stats.UnregisterExporter(sse)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %q: %v", addr, err)
+	}
+
+	// The stats handler extracts the trace context propagated by
+	// clients such as the load generator so that their spans join ours.
+	srv := grpc.NewServer(grpc.StatsHandler(ocgrpc.NewServerStatsHandler()))
+	RegisterAppServer(srv, new(appServer))
+
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	// Reflection lets tools like grpcurl discover the services.
+	reflection.Register(srv)
+
+	pingCtx, cancelPing := context.WithCancel(ctx)
+	pingDoneChan := make(chan struct{})
+	go func() {
+		defer close(pingDoneChan)
+		reportHealth(pingCtx, hs, healthInterval)
+	}()
+
+	errsChan := make(chan error, 1)
+	go func() {
+		log.Printf("Serving on %q", addr)
+		errsChan <- srv.Serve(ln)
+	}()
+
+	sigsChan := make(chan os.Signal, 1)
+	signal.Notify(sigsChan, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case err := <-errsChan:
+		log.Printf("Serve err: %v", err)
+	case sig := <-sigsChan:
+		log.Printf("Received %v, shutting down", sig)
+	}
+
+	// Stop advertising as healthy so that load balancers
+	// stop routing new requests to us while we drain.
+	// Wait for any ping in flight first, as it could otherwise
+	// report SERVING again after NOT_SERVING is set below.
+	cancelPing()
+	<-pingDoneChan
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	hs.SetServingStatus(appServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
+	gracefulStop(srv, drainTimeout)
+
+	// Flush any buffered data before the exporters are unregistered.
+	ste.Flush()
+	sse.Flush()
+	trace.UnregisterExporter(ste)
+	stats.UnregisterExporter(sse)
+}
+
+// appServiceName is the fully qualified name of the App
+// service as reported by the health service.
+const appServiceName = "main.App"
+
+// gracefulStop waits for in-flight RPCs to complete but
+// forcefully stops the server if that takes longer than timeout.
+func gracefulStop(srv *grpc.Server, timeout time.Duration) {
+	doneChan := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(doneChan)
+	}()
+
+	select {
+	case <-doneChan:
+	case <-time.After(timeout):
+		log.Printf("Drain timeout of %s elapsed, forcefully stopping", timeout)
+		srv.Stop()
+	}
+}
+
+// reportHealth periodically pings Spanner and reflects
+// the result in the health service until ctx is cancelled.
+func reportHealth(ctx context.Context, hs *health.Server, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		status := healthpb.HealthCheckResponse_SERVING
+		if err := pingStore(ctx); err != nil {
+			log.Printf("Spanner ping err: %v", err)
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		hs.SetServingStatus("", status)
+		hs.SetServingStatus(appServiceName, status)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func pingStore(ctx context.Context) error {
+	ctx = trace.StartSpan(ctx, "/ping-store")
+	defer trace.EndSpan(ctx)
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	iter := sc.Single().Query(ctx, spanner.NewStatement("SELECT 1"))
+	defer iter.Stop()
+
+	if _, err := iter.Next(); err != nil {
+		stats.Record(ctx, genericErrorCount.M(1))
+		return err
+	}
+	return nil
+}
+
+type appServer struct{}
+
+var _ AppServer = (*appServer)(nil)
+
+func (as *appServer) Create(ctx context.Context, rsv *Reservation) (*Reservation, error) {
+	return addReservation(ctx, rsv)
+}
+
+func (as *appServer) FindByCode(ctx context.Context, rsv *Reservation) (*Reservation, error) {
+	return findReservationByCode(ctx, rsv.Code)
+}
+
+func (as *appServer) FindByEmail(ctx context.Context, rsv *Reservation) (*Reservations, error) {
+	rsvl, err := findReservationsForEmail(ctx, rsv.Email)
+	if err != nil {
+		return nil, err
+	}
+	return &Reservations{Items: rsvl}, nil
+}
+
+func (as *appServer) Delete(ctx context.Context, rsv *Reservation) (*Error, error) {
+	if err := removeReservationByCode(ctx, rsv.Code); err != nil {
+		return nil, err
+	}
+	return new(Error), nil
 }
 
 var (
@@ -131,9 +286,14 @@ func viewNoErr(v *stats.View, err error) *stats.View {
 	return v
 }
 
+func recordLookupTime(ctx context.Context, startTime time.Time) {
+	stats.Record(ctx, timespentLookup.M(time.Since(startTime).Seconds()))
+}
+
 func findReservationByCode(ctx context.Context, code string) (*Reservation, error) {
 	ctx = trace.StartSpan(ctx, "/find-reservation-by-code")
 	defer trace.EndSpan(ctx)
+	defer recordLookupTime(ctx, time.Now())
 
 	row, err := sc.Single().ReadRow(ctx, "Reservations", spanner.Key{code}, []string{"code"})
 	if err != nil {
@@ -178,6 +338,7 @@ func removeReservationByCode(ctx context.Context, code string) error {
 func findReservationsForEmail(ctx context.Context, email string) ([]*Reservation, error) {
 	ctx = trace.StartSpan(ctx, "/find-reservation-for-email")
 	defer trace.EndSpan(ctx)
+	defer recordLookupTime(ctx, time.Now())
 
 	iter := sc.Single().Read(ctx, "Reservations", spanner.Key{email}, []string{"email"})
 	var rsrvl []*Reservation
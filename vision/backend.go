@@ -40,15 +40,26 @@ var (
 	base64ImageCountMeasure stats.Measure
 	dbSaveErrorCountMeasure stats.Measure
 	urlCountMeasure         stats.Measure
+
+	detector Detector
 )
 
 func init() {
 	port := flag.Int("port", 8899, "the port to run the server on")
 	projectID := flag.String("gcp-id", "opencensus-demos", "the Google Cloud Platform projectID")
+	detectorName := flag.String("detector", detectorCloud,
+		"the image detector to use: cloud for the Cloud Vision API or local to run offline")
+	fixturesDir := flag.String("fixtures-dir", "", "the directory of canned results for the local detector")
 	flag.Parse()
 
 	addr = fmt.Sprintf(":%d", *port)
 
+	var err error
+	detector, err = newDetector(context.Background(), *detectorName, *fixturesDir)
+	if err != nil {
+		log.Fatalf("detector: %v", err)
+	}
+
 	promExp, err := prometheus.NewExporter(prometheus.Options{})
 	if err != nil {
 		log.Fatalf("prometheus exporter: %v", err)
@@ -59,11 +70,16 @@ func init() {
 	stackDExp, err := stackdriver.NewExporter(stackdriver.Options{
 		ProjectID: *projectID,
 	})
-	if err != nil {
+	switch {
+	case err == nil:
+		stats.RegisterExporter(stackDExp)
+		trace.RegisterExporter(stackDExp)
+	case *detectorName == detectorLocal:
+		// Running offline, so there are likely no credentials for Stackdriver either.
+		log.Printf("stackDriver exporter: %v; only exporting to Prometheus", err)
+	default:
 		log.Fatalf("stackDriver exporter: %v", err)
 	}
-	stats.RegisterExporter(stackDExp)
-	trace.RegisterExporter(stackDExp)
 
 	errCountMeasure = mustCreateCountMeasure(func() (stats.Measure, error) {
 		return stats.NewMeasureInt64("vision/measures/errors_cum", "number of errors", "error")
@@ -164,11 +180,6 @@ func detectFacesAndLogos(r io.Reader, ctx context.Context) (*DetectionResult, er
 	ctx, span := trace.StartSpan(ctx, "/detect-faces-and-logos")
 	defer span.End()
 
-	client, err := vision.NewImageAnnotatorClient(ctx)
-	if err != nil {
-		return nil, err
-	}
-
 	cw := new(countWriter)
 	mr := io.TeeReader(r, cw)
 	img, err := vision.NewImageFromReader(mr)
@@ -179,10 +190,7 @@ func detectFacesAndLogos(r io.Reader, ctx context.Context) (*DetectionResult, er
 	stats.Record(ctx, byteCountMeasure.(*stats.MeasureInt64).M(int64(cw.n)))
 	go stats.Record(ctx, imageCountMeasure.(*stats.MeasureInt64).M(int64(1)))
 
-	res := new(DetectionResult)
-	res.Faces, res.FacesErr = client.DetectFaces(ctx, img, nil, 1000)
-	res.Labels, res.LabelsErr = client.DetectLabels(ctx, img, nil, 1000)
-	return res, nil
+	return detector.Detect(ctx, img)
 }
 
 type DetectionResult struct {
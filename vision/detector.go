@@ -0,0 +1,71 @@
+// Copyright 2017, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"cloud.google.com/go/vision/apiv1"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+
+	"go.opencensus.io/trace"
+)
+
+// Detector finds the faces in an image and labels what it shows.
+type Detector interface {
+	// Detect annotates img. It only fails if img can't be processed at
+	// all; failures of the individual detections are reported in the
+	// result's FacesErr and LabelsErr instead.
+	Detect(ctx context.Context, img *pb.Image) (*DetectionResult, error)
+}
+
+const (
+	detectorCloud = "cloud"
+	detectorLocal = "local"
+)
+
+func newDetector(ctx context.Context, name, fixturesDir string) (Detector, error) {
+	switch name {
+	case detectorCloud:
+		client, err := vision.NewImageAnnotatorClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &cloudDetector{client: client}, nil
+	case detectorLocal:
+		return &localDetector{dir: fixturesDir}, nil
+	default:
+		return nil, fmt.Errorf("unknown detector %q", name)
+	}
+}
+
+// cloudDetector detects faces and labels with the Cloud Vision API.
+type cloudDetector struct {
+	client *vision.ImageAnnotatorClient
+}
+
+var _ Detector = (*cloudDetector)(nil)
+
+func (cd *cloudDetector) Detect(ctx context.Context, img *pb.Image) (*DetectionResult, error) {
+	ctx, span := trace.StartSpan(ctx, "/cloud-vision-detect")
+	defer span.End()
+
+	res := new(DetectionResult)
+	res.Faces, res.FacesErr = cd.client.DetectFaces(ctx, img, nil, 1000)
+	res.Labels, res.LabelsErr = cd.client.DetectLabels(ctx, img, nil, 1000)
+	return res, nil
+}
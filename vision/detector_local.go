@@ -0,0 +1,191 @@
+// Copyright 2017, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	// Register the formats that uploads and URLs are decoded from.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"golang.org/x/net/context"
+
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+
+	"go.opencensus.io/trace"
+)
+
+// localDetector annotates images without network access or Google
+// credentials, so that the demo can be run and tried offline. Images are
+// decoded in Go and, unless there's a fixture for them, given made up
+// but deterministic annotations: a face in the middle half of the image
+// and labels for its format, orientation and dominant color.
+//
+// Fixtures are JSON files in dir holding the "faces" and "labels" to
+// respond with, in the same format that /upload and /url respond with,
+// and are named after the hex encoded SHA-256 of the image, e.g.
+// "5d41402abc4b2a76....json".
+type localDetector struct {
+	dir string
+}
+
+var _ Detector = (*localDetector)(nil)
+
+func (ld *localDetector) Detect(ctx context.Context, img *pb.Image) (*DetectionResult, error) {
+	ctx, span := trace.StartSpan(ctx, "/local-detect")
+	defer span.End()
+
+	decoded, format, err := decodeImage(ctx, img.Content)
+	if err != nil {
+		return nil, err
+	}
+	if ld.dir != "" {
+		res, err := ld.loadFixture(ctx, img.Content)
+		if err == nil {
+			return res, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return fakeDetection(decoded, format), nil
+}
+
+func decodeImage(ctx context.Context, content []byte) (image.Image, string, error) {
+	_, span := trace.StartSpan(ctx, "/decode-image")
+	defer span.End()
+
+	img, format, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding image: %v", err)
+	}
+	return img, format, nil
+}
+
+func fixtureName(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]) + ".json"
+}
+
+// detectionFixture is the part of a DetectionResult that fixtures hold.
+type detectionFixture struct {
+	Faces  []*pb.FaceAnnotation   `json:"faces"`
+	Labels []*pb.EntityAnnotation `json:"labels"`
+}
+
+func (ld *localDetector) loadFixture(ctx context.Context, content []byte) (*DetectionResult, error) {
+	_, span := trace.StartSpan(ctx, "/load-fixture")
+	defer span.End()
+
+	path := filepath.Join(ld.dir, fixtureName(content))
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fixture := new(detectionFixture)
+	if err := json.Unmarshal(blob, fixture); err != nil {
+		return nil, fmt.Errorf("parsing fixture %q: %v", path, err)
+	}
+	return &DetectionResult{Faces: fixture.Faces, Labels: fixture.Labels}, nil
+}
+
+func fakeDetection(img image.Image, format string) *DetectionResult {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	poly := &pb.BoundingPoly{
+		Vertices: []*pb.Vertex{
+			{X: int32(b.Min.X + w/4), Y: int32(b.Min.Y + h/4)},
+			{X: int32(b.Min.X + 3*w/4), Y: int32(b.Min.Y + h/4)},
+			{X: int32(b.Min.X + 3*w/4), Y: int32(b.Min.Y + 3*h/4)},
+			{X: int32(b.Min.X + w/4), Y: int32(b.Min.Y + 3*h/4)},
+		},
+	}
+
+	orientation := "square"
+	switch {
+	case w > h:
+		orientation = "landscape"
+	case w < h:
+		orientation = "portrait"
+	}
+
+	return &DetectionResult{
+		Faces: []*pb.FaceAnnotation{{
+			BoundingPoly:          poly,
+			FdBoundingPoly:        poly,
+			DetectionConfidence:   0.5,
+			LandmarkingConfidence: 0.5,
+		}},
+		Labels: []*pb.EntityAnnotation{
+			{Description: dominantColor(img), Score: 0.9},
+			{Description: orientation, Score: 0.8},
+			{Description: format, Score: 0.7},
+		},
+	}
+}
+
+// namedColors are the colors that an image's dominant color is named after.
+var namedColors = []struct {
+	name string
+	c    color.RGBA
+}{
+	{"black", color.RGBA{0, 0, 0, 0xff}},
+	{"white", color.RGBA{0xff, 0xff, 0xff, 0xff}},
+	{"gray", color.RGBA{0x80, 0x80, 0x80, 0xff}},
+	{"red", color.RGBA{0xff, 0, 0, 0xff}},
+	{"green", color.RGBA{0, 0xff, 0, 0xff}},
+	{"blue", color.RGBA{0, 0, 0xff, 0xff}},
+	{"yellow", color.RGBA{0xff, 0xff, 0, 0xff}},
+	{"orange", color.RGBA{0xff, 0xa5, 0, 0xff}},
+	{"purple", color.RGBA{0x80, 0, 0x80, 0xff}},
+}
+
+// dominantColor names the color closest to the average of a grid of at
+// most 64x64 of img's pixels.
+func dominantColor(img image.Image) string {
+	b := img.Bounds()
+	stepX, stepY := b.Dx()/64+1, b.Dy()/64+1
+	var r, g, bl, n uint64
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		for x := b.Min.X; x < b.Max.X; x += stepX {
+			pr, pg, pbl, _ := img.At(x, y).RGBA()
+			r, g, bl, n = r+uint64(pr>>8), g+uint64(pg>>8), bl+uint64(pbl>>8), n+1
+		}
+	}
+	if n == 0 {
+		return namedColors[0].name
+	}
+	avg := color.RGBA{uint8(r / n), uint8(g / n), uint8(bl / n), 0xff}
+
+	best, bestDist := namedColors[0].name, -1
+	for _, nc := range namedColors {
+		dr, dg, db := int(avg.R)-int(nc.c.R), int(avg.G)-int(nc.c.G), int(avg.B)-int(nc.c.B)
+		if dist := dr*dr + dg*dg + db*db; bestDist < 0 || dist < bestDist {
+			best, bestDist = nc.name, dist
+		}
+	}
+	return best
+}